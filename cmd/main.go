@@ -2,14 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/marcocampos/tiny-http/internal/server"
 )
 
+// echoPath is where -debug-echo serves the echo handler
+const echoPath = "/_echo"
+
+// Where -health-checks serves the liveness and readiness probes
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
 func main() {
 	// Define command-line flags
 	var (
@@ -17,6 +31,11 @@ func main() {
 		hostname  = flag.String("hostname", "0.0.0.0", "Hostname or IP address to bind to")
 		port      = flag.String("port", "8080", "Port to listen on")
 		logLevel  = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+		logFormat = flag.String("log-format", "json", "Log format (json, text)")
+		accessLog = flag.String("access-log", "", "File to append access logs to, reopened on SIGHUP (default: stdout)")
+		debugEcho = flag.Bool("debug-echo", false, "Echo POST requests to "+echoPath+" back as JSON, for testing clients")
+		basePath  = flag.String("base-path", "", "Path prefix to serve under, e.g. /files (default: the root)")
+		probes    = flag.Bool("health-checks", false, "Serve liveness and readiness probes at "+healthPath+" and "+readyPath)
 	)
 	flag.Parse()
 
@@ -27,26 +46,162 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Validate directory exists
-	if _, err := os.Stat(*directory); os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "error: directory %s does not exist\n", *directory)
+	if err := validateLogFormat(*logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate directory exists before binding the socket
+	if err := validateDirectory(*directory); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Setup logger
-	logger := setupLogger(*logLevel)
+	logger := setupLogger(*logLevel, *logFormat, os.Stdout)
+
+	// Serve what a symlinked directory points to now, so a deploy can swap
+	// the link and send SIGHUP to move the server to the new root
+	root, err := filepath.EvalSymlinks(*directory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Create server
 	addr := fmt.Sprintf("%s:%s", *hostname, *port)
-	srv := server.NewHTTPServer(addr, *directory, logger)
+	srv := server.NewHTTPServer(addr, root, logger)
+	srv.BasePath = *basePath
+
+	// Cancel the context on SIGINT/SIGTERM so the server drains and exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := srv.ListenAndServe(context.Background()); err != nil {
+	// Send access logs to their own file if requested
+	var logFile *server.LogFile
+	if *accessLog != "" {
+		logFile, err = server.OpenLogFile(*accessLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+
+		srv.Middlewares = server.DefaultMiddlewares(setupLogger(*logLevel, *logFormat, logFile))
+	}
+
+	// Echo endpoint for testing clients, never enabled by default
+	if *debugEcho {
+		srv.Router.(*server.HTTPRouter).AddMethodRoute("POST", echoPath, &server.EchoHandler{})
+		logger.Warn("debug echo endpoint enabled", "path", echoPath)
+	}
+
+	// Probes for orchestrators such as Kubernetes
+	if *probes {
+		srv.Router.(*server.HTTPRouter).AddRoute(healthPath, &server.HealthHandler{})
+		srv.Router.(*server.HTTPRouter).AddRoute(readyPath, &server.ReadinessHandler{Server: srv})
+	}
+
+	// Redirects, headers, CORS origins and cache lifetime from the document
+	// root's rules file; the latter two are re-read on SIGHUP
+	rules, err := server.LoadRules(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	srv.Middlewares = append(srv.Middlewares, srv.CORSMiddleware())
+	rules.Apply(srv)
+	go handleHangups(ctx, srv, *directory, logFile, logger)
+
+	if err := serve(ctx, srv); err != nil {
 		logger.Error("server error", "error", err)
+		stop()
 		os.Exit(1)
 	}
 }
 
-func setupLogger(level string) *slog.Logger {
+// validateDirectory checks that dir exists and is a directory
+func validateDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("directory %s does not exist", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access directory %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// validateLogFormat checks that format names a log format setupLogger knows
+func validateLogFormat(format string) error {
+	if format != "json" && format != "text" {
+		return fmt.Errorf("unknown log format %q, want json or text", format)
+	}
+	return nil
+}
+
+// handleHangups reopens the access log, if there is one, and then reloads
+// srv's configuration each time the process receives SIGHUP
+func handleHangups(ctx context.Context, srv *server.HTTPServer, directory string, logFile *server.LogFile, logger *slog.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					logger.Error("failed to reopen access log", "error", err)
+				} else {
+					logger.Info("access log reopened")
+				}
+			}
+			reloadConfig(srv, directory, logger)
+		}
+	}
+}
+
+// reloadConfig resolves directory again, in case it is a symlink that now
+// points elsewhere, re-reads the rules file there and applies the reloadable
+// settings to srv, keeping connections open
+func reloadConfig(srv *server.HTTPServer, directory string, logger *slog.Logger) {
+	root, err := filepath.EvalSymlinks(directory)
+	var rules *server.Rules
+	if err == nil {
+		rules, err = server.LoadRules(root)
+	}
+	if err == nil {
+		err = srv.Reload(rules.ReloadConfig(root))
+	}
+	if err != nil {
+		logger.Error("failed to reload configuration", "error", err)
+		return
+	}
+	logger.Info("configuration reloaded",
+		"directory", root,
+		"cors_origins", len(rules.CORSOrigins),
+		"cache_max_age", rules.CacheMaxAge,
+	)
+}
+
+// serve runs srv until ctx is cancelled, treating a graceful shutdown as success
+func serve(ctx context.Context, srv server.Server) error {
+	if err := srv.ListenAndServe(ctx); err != nil && !errors.Is(err, server.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// setupLogger creates a logger writing to w at the given level, using
+// human-readable text when format is "text" and JSON otherwise
+func setupLogger(level string, format string, w io.Writer) *slog.Logger {
 	var logLevel slog.Level
 	switch level {
 	case "debug":
@@ -65,6 +220,12 @@ func setupLogger(level string) *slog.Logger {
 		Level: logLevel,
 	}
 
-	handler := slog.NewTextHandler(os.Stdout, opts)
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		handler = slog.NewJSONHandler(w, opts)
+	}
 	return slog.New(handler)
 }
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/marcocampos/tiny-http/internal/server"
 )
 
 func TestSetupLogger(t *testing.T) {
@@ -27,22 +33,54 @@ func TestSetupLogger(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			logger := setupLogger(tt.level)
+			logger := setupLogger(tt.level, "text", io.Discard)
 			
 			// Test that logger is created
 			if logger == nil {
 				t.Fatal("Expected logger to be created")
 			}
 			
-			// We can't directly test the level, but we can verify the logger works
-			// by checking it doesn't panic when used
-			logger.Info("test message")
-			logger.Debug("debug message")
-			logger.Error("error message")
+			// The configured level must be enabled, the one below it must not
+			if !logger.Enabled(context.Background(), tt.expected) {
+				t.Errorf("Expected level %v to be enabled", tt.expected)
+			}
+			if logger.Enabled(context.Background(), tt.expected-1) {
+				t.Errorf("Expected level below %v to be disabled", tt.expected)
+			}
 		})
 	}
 }
 
+func TestSetupLoggerFormat(t *testing.T) {
+	t.Run("json format", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := setupLogger("info", "json", &buf)
+		logger.Info("test message", "key", "value")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Expected JSON output, got %q: %v", buf.String(), err)
+		}
+		if entry["msg"] != "test message" || entry["key"] != "value" {
+			t.Errorf("Unexpected JSON log entry: %v", entry)
+		}
+	})
+
+	t.Run("text format", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := setupLogger("info", "text", &buf)
+		logger.Info("test message", "key", "value")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err == nil {
+			t.Errorf("Expected text output, got JSON: %q", buf.String())
+		}
+		if !strings.Contains(buf.String(), `msg="test message" key=value`) {
+			t.Errorf("Unexpected text log output: %q", buf.String())
+		}
+	})
+}
+
 func TestMainFlags(t *testing.T) {
 	// Save original args and command line
 	oldArgs := os.Args
@@ -208,3 +246,140 @@ func TestMainValidFlags(t *testing.T) {
 		t.Errorf("Expected log level to be debug, got %s", *logLevel)
 	}
 }
+
+func TestServeGracefulShutdown(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := server.NewHTTPServer("127.0.0.1:0", t.TempDir(), logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv)
+	}()
+
+	// Wait for the server to bind before simulating the signal
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ListenerAddr() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if srv.ListenerAddr() == nil {
+		t.Fatal("Server did not start")
+	}
+
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			t.Errorf("serve() error = %v, want nil", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("serve() did not return after cancellation")
+	}
+}
+
+func TestValidateDirectory(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("not a directory"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		dir         string
+		expectedErr string
+	}{
+		{"valid directory", tempDir, ""},
+		{"non-existent directory", filepath.Join(tempDir, "missing"), "does not exist"},
+		{"file instead of directory", filePath, "is not a directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDirectory(tt.dir)
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("validateDirectory(%s) error = %v, want error containing %q", tt.dir, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+// TestReloadConfig tests that a reload follows a swapped directory symlink
+// and picks up the new root's rules
+func TestReloadConfig(t *testing.T) {
+	base := t.TempDir()
+	releases := map[string]string{"v1": "first release", "v2": "second release"}
+	for name, content := range releases {
+		dir := filepath.Join(base, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Failed to create release: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create index: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "v2", server.RulesFileName), []byte("cors https://app.example\n"), 0644); err != nil {
+		t.Fatalf("Failed to create rules file: %v", err)
+	}
+	current := filepath.Join(base, "current")
+	if err := os.Symlink(filepath.Join(base, "v1"), current); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	root, err := filepath.EvalSymlinks(current)
+	if err != nil {
+		t.Fatalf("Failed to resolve root: %v", err)
+	}
+	srv := server.NewHTTPServer("127.0.0.1:0", root, logger)
+	srv.Middlewares = append(srv.Middlewares, srv.CORSMiddleware())
+
+	get := func() string {
+		out := srv.ServeRaw([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example\r\nConnection: close\r\n\r\n"))
+		return string(out)
+	}
+	if out := get(); !strings.Contains(out, releases["v1"]) {
+		t.Fatalf("Expected the first release, got %q", out)
+	}
+
+	// Swap the link as a deploy would, then reload
+	next := filepath.Join(base, "next")
+	if err := os.Symlink(filepath.Join(base, "v2"), next); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Rename(next, current); err != nil {
+		t.Fatalf("Failed to swap symlink: %v", err)
+	}
+	if out := get(); !strings.Contains(out, releases["v1"]) {
+		t.Errorf("Expected the first release until the reload, got %q", out)
+	}
+
+	reloadConfig(srv, current, logger)
+	out := get()
+	if !strings.Contains(out, releases["v2"]) {
+		t.Errorf("Expected the second release after the reload, got %q", out)
+	}
+	if !strings.Contains(out, "Access-Control-Allow-Origin: https://app.example") {
+		t.Errorf("Expected the new root's CORS origins, got %q", out)
+	}
+}
+
+func TestValidateLogFormat(t *testing.T) {
+	for format, valid := range map[string]bool{"json": true, "text": true, "": false, "JSON": false, "logfmt": false} {
+		err := validateLogFormat(format)
+		if valid && err != nil {
+			t.Errorf("validateLogFormat(%q) error = %v, want nil", format, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("validateLogFormat(%q) = nil, want an error", format)
+		}
+	}
+}
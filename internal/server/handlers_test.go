@@ -1,12 +1,34 @@
 package server
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestFileHandlerDetectContentType(t *testing.T) {
@@ -30,6 +52,12 @@ func TestFileHandlerDetectContentType(t *testing.T) {
 		{"test.txt", []byte("text"), "text/plain; charset=utf-8", "Text file"},
 		{"test.md", []byte("# Header"), "text/markdown; charset=utf-8", "Markdown file"},
 
+		// Web app assets
+		{"test.mjs", []byte("export {}"), "application/javascript; charset=utf-8", "JavaScript module"},
+		{"app.js.map", []byte("{}"), "application/json; charset=utf-8", "Source map"},
+		{"site.webmanifest", []byte("{}"), "application/manifest+json; charset=utf-8", "Web app manifest"},
+		{"test.wasm", []byte{}, "application/wasm", "WebAssembly module"},
+
 		// Images
 		{"test.jpg", []byte{}, "image/jpeg", "JPEG file"},
 		{"test.jpeg", []byte{}, "image/jpeg", "JPEG file (jpeg extension)"},
@@ -73,6 +101,93 @@ func TestFileHandlerDetectContentType(t *testing.T) {
 	}
 }
 
+func TestFileHandlerSniffContentType(t *testing.T) {
+	tempDir := t.TempDir()
+
+	pngSignature := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0x0d, 'I', 'H', 'D', 'R'}
+
+	tests := []struct {
+		filename string
+		data     []byte
+		expected string
+	}{
+		{"image.bin", pngSignature, "image/png"},
+		{"legacy.xyz123", []byte("<!DOCTYPE html><html><body>legacy</body></html>"), "text/html; charset=utf-8"},
+		{"notes.unknownext", []byte("just some text"), "text/plain; charset=utf-8"},
+		{"empty.unknownext", []byte{}, "text/plain; charset=utf-8"},
+		{"noext", []byte("plain"), "text/plain; charset=utf-8"},
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        logger,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(tempDir, tt.filename), tt.data, 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/" + tt.filename,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.Headers["Content-Type"] != tt.expected {
+				t.Errorf("Content-Type = %v, want %v", resp.Headers["Content-Type"], tt.expected)
+			}
+		})
+	}
+}
+
+func TestFileHandlerDetectCharset(t *testing.T) {
+	tempDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		filename      string
+		data          []byte
+		detectCharset bool
+		expected      string
+	}{
+		{"utf16be.txt", []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, true, "text/plain; charset=utf-16be"},
+		{"utf16le.txt", []byte{0xFF, 0xFE, 'h', 0, 'i', 0}, true, "text/plain; charset=utf-16le"},
+		{"utf8bom.html", []byte{0xEF, 0xBB, 0xBF, '<', 'p', '>'}, true, "text/html; charset=utf-8"},
+		{"plain.txt", []byte("hello"), true, "text/plain; charset=utf-8"},
+		{"short.txt", []byte{0xFE}, true, "text/plain; charset=utf-8"},
+		{"disabled.txt", []byte{0xFF, 0xFE, 'h', 0}, false, "text/plain; charset=utf-8"},
+		{"image.png", []byte{0xFF, 0xFE, 0, 0}, true, "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(tempDir, tt.filename), tt.data, 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			handler := &FileHandler{FileDirectory: tempDir, Logger: logger, DetectCharset: tt.detectCharset}
+			req := &Request{Method: "GET", Path: "/" + tt.filename, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.Headers["Content-Type"] != tt.expected {
+				t.Errorf("Content-Type = %v, want %v", resp.Headers["Content-Type"], tt.expected)
+			}
+		})
+	}
+}
+
 func TestFileHandlerShouldCache(t *testing.T) {
 	handler := &FileHandler{
 		Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
@@ -439,6 +554,2286 @@ func TestFileHandlerHeaders(t *testing.T) {
 	}
 }
 
+func TestFileHandlerIfUnmodifiedSince(t *testing.T) {
+	tempDir := t.TempDir()
+	testFile := filepath.Join(tempDir, "test.txt")
+	if err := os.WriteFile(testFile, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	modTime := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(testFile, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        logger,
+	}
+
+	tests := []struct {
+		name           string
+		header         string
+		expectedStatus int
+	}{
+		{"date before modtime", modTime.Add(-time.Hour).Format(http.TimeFormat), 412},
+		{"date equal to modtime", modTime.Format(http.TimeFormat), 200},
+		{"date after modtime", modTime.Add(time.Hour).Format(http.TimeFormat), 200},
+		{"RFC 850 date before modtime", modTime.Add(-time.Hour).Format(time.RFC850), 412},
+		{"unparseable date is ignored", "not a date", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     "/test.txt",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"If-Unmodified-Since": tt.header,
+				},
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %v, want %v", resp.StatusCode, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestFileHandlerRootRemoved tests that a deleted document root gets a 503 and a warning
+func TestFileHandlerRootRemoved(t *testing.T) {
+	rootDir := filepath.Join(t.TempDir(), "site")
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		t.Fatalf("Failed to create document root: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "index.html"), []byte("home"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	var logs bytes.Buffer
+	handler := &FileHandler{
+		FileDirectory: rootDir,
+		Logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+
+	fetch := func(path string) *Response {
+		req := &Request{Method: "GET", Path: path, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", path, err)
+		}
+		return resp
+	}
+
+	if resp := fetch("/missing.html"); resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 while the root exists, got %d", resp.StatusCode)
+	}
+
+	if err := os.RemoveAll(rootDir); err != nil {
+		t.Fatalf("Failed to remove document root: %v", err)
+	}
+
+	for _, path := range []string{"/", "/index.html", "/missing.html"} {
+		if resp := fetch(path); resp.StatusCode != 503 {
+			t.Errorf("%s: StatusCode = %d, want 503", path, resp.StatusCode)
+		}
+	}
+	if count := strings.Count(logs.String(), "document root is unavailable"); count != 1 {
+		t.Errorf("Expected one warning about the missing root, got %d:\n%s", count, logs.String())
+	}
+	if strings.Contains(logs.String(), rootDir) {
+		t.Error("Warning should not reveal the document root's location")
+	}
+
+	// Recreating the root restores normal answers
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		t.Fatalf("Failed to recreate document root: %v", err)
+	}
+	if resp := fetch("/missing.html"); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 once the root is back, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(logs.String(), "document root is available again") {
+		t.Error("Expected a log entry when the root came back")
+	}
+}
+
+func TestFileHandlerNegotiateContent(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"index.html":  "<html>home</html>",
+		"index.json":  `{"page": "home"}`,
+		"about.html":  "<html>about</html>",
+		"index.html~": "backup",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	handler := &FileHandler{
+		FileDirectory:    tempDir,
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		NegotiateContent: true,
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		expectedBody string
+		expectedVary string
+	}{
+		{"json preferred", "/", "application/json", files["index.json"], "Accept"},
+		{"html preferred", "/", "text/html", files["index.html"], "Accept"},
+		{"json explicitly named", "/index.html", "application/json", files["index.json"], "Accept"},
+		{"q-values", "/", "application/json;q=0.5, text/html", files["index.html"], "Accept"},
+		{"wildcard keeps requested file", "/index.json", "*/*", files["index.json"], "Accept"},
+		{"specific range over wildcard", "/", "text/*;q=0.2, application/json;q=0.4", files["index.json"], "Accept"},
+		{"no accept header", "/", "", files["index.html"], "Accept"},
+		{"nothing acceptable", "/", "image/png", files["index.html"], "Accept"},
+		{"single variant", "/about.html", "application/json", files["about.html"], ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: "GET", Path: tt.path, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+			if tt.accept != "" {
+				req.Headers["Accept"] = tt.accept
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", resp.Body, tt.expectedBody)
+			}
+			if resp.Headers["Vary"] != tt.expectedVary {
+				t.Errorf("Vary = %q, want %q", resp.Headers["Vary"], tt.expectedVary)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		plain := &FileHandler{FileDirectory: tempDir, Logger: handler.Logger}
+		req := &Request{Method: "GET", Path: "/", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept": "application/json"}}
+		resp, err := plain.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(resp.Body) != files["index.html"] {
+			t.Errorf("Body = %q, want the requested index.html", resp.Body)
+		}
+	})
+}
+
+func TestFileHandlerPrecompressed(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"app.js":        "console.log('plain')",
+		"app.js.br":     "brotli bytes",
+		"app.js.gz":     "gzip bytes",
+		"style.css":     "body {}",
+		"style.css.gz":  "gzip css",
+		"readme.txt":    "no siblings",
+		"readme.txt.zz": "unknown suffix",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Precompressed: true,
+	}
+	fetch := func(h *FileHandler, path string, headers map[string]string) *Response {
+		req := &Request{Method: "GET", Path: path, Protocol: "HTTP/1.1", Headers: headers}
+		resp, err := h.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name             string
+		path             string
+		acceptEncoding   string
+		expectedBody     string
+		expectedEncoding string
+	}{
+		{"accepts both prefers br", "/app.js", "gzip, deflate, br", files["app.js.br"], "br"},
+		{"accepts only gzip", "/app.js", "gzip", files["app.js.gz"], "gzip"},
+		{"gzip preferred by q-value", "/app.js", "br;q=0.5, gzip", files["app.js.gz"], "gzip"},
+		{"br refused", "/app.js", "*, br;q=0", files["app.js.gz"], "gzip"},
+		{"wildcard", "/app.js", "*", files["app.js.br"], "br"},
+		{"no gzip", "/app.js", "deflate", files["app.js"], ""},
+		{"no accept-encoding", "/app.js", "", files["app.js"], ""},
+		{"only gz sibling", "/style.css", "gzip, br", files["style.css.gz"], "gzip"},
+		{"no siblings", "/readme.txt", "gzip, br", files["readme.txt"], ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.acceptEncoding != "" {
+				headers["Accept-Encoding"] = tt.acceptEncoding
+			}
+			resp := fetch(handler, tt.path, headers)
+			plain := fetch(handler, tt.path, map[string]string{})
+
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", resp.Body, tt.expectedBody)
+			}
+			if resp.Headers["Content-Encoding"] != tt.expectedEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", resp.Headers["Content-Encoding"], tt.expectedEncoding)
+			}
+			if resp.Headers["Content-Type"] != plain.Headers["Content-Type"] {
+				t.Errorf("Content-Type = %q, want the plain file's %q", resp.Headers["Content-Type"], plain.Headers["Content-Type"])
+			}
+			if resp.Headers["Content-Length"] != strconv.Itoa(len(tt.expectedBody)) {
+				t.Errorf("Content-Length = %q, want %d", resp.Headers["Content-Length"], len(tt.expectedBody))
+			}
+			if tt.expectedEncoding != "" && resp.Headers["Vary"] != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", resp.Headers["Vary"])
+			}
+		})
+	}
+
+	t.Run("range request", func(t *testing.T) {
+		resp := fetch(handler, "/app.js", map[string]string{"Accept-Encoding": "br", "Range": "bytes=0-6"})
+		if resp.StatusCode != 206 || resp.Headers["Content-Encoding"] != "" {
+			t.Errorf("Got %d with Content-Encoding %q, want a 206 of the plain file", resp.StatusCode, resp.Headers["Content-Encoding"])
+		}
+	})
+
+	t.Run("head request", func(t *testing.T) {
+		req := &Request{Method: "HEAD", Path: "/app.js", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": "gzip, br"}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Headers["Content-Encoding"] != "" || resp.Headers["Content-Length"] != strconv.Itoa(len(files["app.js"])) {
+			t.Errorf("Got Content-Encoding %q and Content-Length %q, want the plain file's headers", resp.Headers["Content-Encoding"], resp.Headers["Content-Length"])
+		}
+	})
+
+	t.Run("head request", func(t *testing.T) {
+		req := &Request{Method: "HEAD", Path: "/app.js", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": "gzip, br"}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		plain := fetch(handler, "/app.js", map[string]string{})
+		if resp.Headers["Content-Encoding"] != plain.Headers["Content-Encoding"] || resp.Headers["Content-Length"] != strconv.Itoa(len(files["app.js"])) {
+			t.Errorf("Got Content-Encoding %q and Content-Length %q, want the plain file's headers", resp.Headers["Content-Encoding"], resp.Headers["Content-Length"])
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		plain := &FileHandler{FileDirectory: tempDir, Logger: handler.Logger}
+		resp := fetch(plain, "/app.js", map[string]string{"Accept-Encoding": "gzip, br"})
+		if string(resp.Body) != files["app.js"] || resp.Headers["Content-Encoding"] != "" {
+			t.Errorf("Body = %q with Content-Encoding %q, want the plain file", resp.Body, resp.Headers["Content-Encoding"])
+		}
+	})
+}
+
+func TestFileHandlerOptions(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "video.mp4"), []byte("not really a video"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	options := func(path string) *Response {
+		req := &Request{Method: "OPTIONS", Path: path, Protocol: "HTTP/1.1", Headers: map[string]string{}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	resp := options("/video.mp4")
+	if resp.StatusCode != 204 {
+		t.Errorf("Status = %d, want 204", resp.StatusCode)
+	}
+	if resp.Headers["Allow"] != "GET, HEAD, OPTIONS" {
+		t.Errorf("Allow = %q, want %q", resp.Headers["Allow"], "GET, HEAD, OPTIONS")
+	}
+	if resp.Headers["Accept-Ranges"] != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", resp.Headers["Accept-Ranges"])
+	}
+	if len(resp.Body) != 0 || resp.Reader != nil {
+		t.Errorf("OPTIONS response has a body")
+	}
+
+	if resp := options("/missing.mp4"); resp.StatusCode != 404 {
+		t.Errorf("Missing file status = %d, want 404", resp.StatusCode)
+	}
+
+	// A default server falls through to its FileHandler for unrouted paths
+	server := NewHTTPServer("127.0.0.1:0", tempDir, handler.Logger)
+	server.Router.AddRoute("/api", &testHandler{response: "api"})
+	for path, expected := range map[string]string{"/video.mp4": "204", "/missing.mp4": "404"} {
+		raw := "OPTIONS " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if code := strings.Fields(status)[1]; code != expected {
+			t.Errorf("OPTIONS %s = %s, want %s", path, code, expected)
+		}
+		if expected == "204" && headers["Accept-Ranges"] != "bytes" {
+			t.Errorf("OPTIONS %s Accept-Ranges = %q, want bytes", path, headers["Accept-Ranges"])
+		}
+	}
+
+	// Routed paths are still answered from their routes
+	raw := "OPTIONS /api HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if status != "HTTP/1.1 200 OK" || headers["Allow"] != "GET, OPTIONS, HEAD" {
+		t.Errorf("OPTIONS /api = %q with Allow %q, want 200 with GET, OPTIONS, HEAD", status, headers["Allow"])
+	}
+}
+
+func TestFileHandler404Page(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	notFoundPage := "<html><body>Custom not found</body></html>"
+
+	tests := []struct {
+		name         string
+		createPage   bool
+		enabled      bool
+		expectedType string
+		expectedBody string
+	}{
+		{"page present", true, true, "text/html; charset=utf-8", notFoundPage},
+		{"page absent", false, true, "text/plain; charset=utf-8", "404 Not Found"},
+		{"page present but disabled", true, false, "text/plain; charset=utf-8", "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			if tt.createPage {
+				if err := os.WriteFile(filepath.Join(tempDir, "404.html"), []byte(notFoundPage), 0644); err != nil {
+					t.Fatalf("Failed to create 404 page: %v", err)
+				}
+			}
+
+			handler := &FileHandler{
+				FileDirectory: tempDir,
+				Logger:        logger,
+				Enable404Page: tt.enabled,
+			}
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/missing.txt",
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != 404 {
+				t.Errorf("StatusCode = %v, want 404", resp.StatusCode)
+			}
+			if resp.Headers["Content-Type"] != tt.expectedType {
+				t.Errorf("Content-Type = %v, want %v", resp.Headers["Content-Type"], tt.expectedType)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", string(resp.Body), tt.expectedBody)
+			}
+			if resp.Headers["Content-Length"] != fmt.Sprintf("%d", len(tt.expectedBody)) {
+				t.Errorf("Content-Length = %v, want %d", resp.Headers["Content-Length"], len(tt.expectedBody))
+			}
+		})
+	}
+}
+
+func TestEchoHandler(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.(*HTTPRouter).AddMethodRoute("POST", "/_echo", &EchoHandler{})
+
+	payload := `{"name": "tiny-http"}`
+	raw := "POST /_echo?debug=1 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Type: application/json\r\n" +
+		"X-Test: echo me\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(payload)) +
+		payload
+
+	status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if status != "HTTP/1.1 200 OK" {
+		t.Fatalf("Expected 200 OK, got %q", status)
+	}
+	if headers["Content-Type"] != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", headers["Content-Type"])
+	}
+
+	var echoed echoResponse
+	if err := json.Unmarshal(body, &echoed); err != nil {
+		t.Fatalf("Response is not valid JSON: %v\n%s", err, body)
+	}
+	if echoed.Method != "POST" || echoed.Path != "/_echo" || echoed.Query != "debug=1" {
+		t.Errorf("Echoed request line = %s %s?%s, want POST /_echo?debug=1", echoed.Method, echoed.Path, echoed.Query)
+	}
+	if echoed.Body != payload {
+		t.Errorf("Echoed body = %q, want %q", echoed.Body, payload)
+	}
+	for name, value := range map[string]string{"Content-Type": "application/json", "X-Test": "echo me", "Host": "localhost"} {
+		if echoed.Headers[name] != value {
+			t.Errorf("Echoed header %s = %q, want %q", name, echoed.Headers[name], value)
+		}
+	}
+}
+
+func TestReverseProxyHandler(t *testing.T) {
+	var seen *http.Request
+	var seenBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen, seenBody = r, string(body)
+		w.Header().Set("X-Upstream", "backend-1")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Set-Cookie", "session=abc; Path=/")
+		w.Header().Add("Set-Cookie", "theme=dark; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"created":true}`)
+	}))
+	defer upstream.Close()
+
+	handler := &ReverseProxyHandler{Upstream: upstream.URL + "/"}
+	req := &Request{
+		Method:     "POST",
+		Path:       "/api/items",
+		RawPath:    "/api/items?draft=1",
+		Query:      "draft=1",
+		Protocol:   "HTTP/1.1",
+		RemoteAddr: "203.0.113.7:54321",
+		Headers: map[string]string{
+			"Host":            "www.example.com",
+			"Content-Type":    "application/json",
+			"Content-Length":  "12",
+			"Connection":      "keep-alive",
+			"X-Forwarded-For": "198.51.100.1",
+		},
+		Body: []byte(`{"name":"a"}`),
+	}
+
+	resp, err := handler.Handle()(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.StatusText != "Created" {
+		t.Errorf("Status = %d %s, want 201 Created", resp.StatusCode, resp.StatusText)
+	}
+	if resp.Headers["X-Upstream"] != "backend-1" {
+		t.Errorf("X-Upstream = %q, want backend-1", resp.Headers["X-Upstream"])
+	}
+	if got := resp.Headers["Set-Cookie"]; got != "theme=dark; Expires=Wed, 21 Oct 2026 07:28:00 GMT" {
+		t.Errorf("Set-Cookie = %q, want the last cookie unjoined", got)
+	}
+	body, err := io.ReadAll(resp.Reader)
+	resp.Reader.Close()
+	if err != nil || string(body) != `{"created":true}` {
+		t.Errorf("Body = %q (%v), want the upstream body", body, err)
+	}
+	if resp.Headers["Content-Length"] != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %q, want %d", resp.Headers["Content-Length"], len(body))
+	}
+
+	if seen.Method != "POST" || seen.URL.Path != "/api/items" || seen.URL.RawQuery != "draft=1" {
+		t.Errorf("Upstream saw %s %s, want POST /api/items?draft=1", seen.Method, seen.URL)
+	}
+	if seenBody != `{"name":"a"}` {
+		t.Errorf("Upstream body = %q, want the request body", seenBody)
+	}
+	if got := seen.Header.Get("X-Forwarded-For"); got != "198.51.100.1, 203.0.113.7" {
+		t.Errorf("X-Forwarded-For = %q, want the client appended", got)
+	}
+	if got := seen.Header.Get("X-Forwarded-Host"); got != "www.example.com" {
+		t.Errorf("X-Forwarded-Host = %q, want www.example.com", got)
+	}
+	if got := seen.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	// An unreachable upstream is a bad gateway, not a handler error
+	upstream.Close()
+	resp, err = handler.Handle()(&Request{Method: "GET", Path: "/", Protocol: "HTTP/1.1", Headers: map[string]string{}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestReverseProxyHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	var logs bytes.Buffer
+	handler := &ReverseProxyHandler{
+		Upstream: upstream.URL,
+		Timeout:  50 * time.Millisecond,
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+
+	start := time.Now()
+	resp, err := handler.Handle()(&Request{Method: "GET", Path: "/slow", Protocol: "HTTP/1.1", Headers: map[string]string{}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Status = %d, want 502", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Waited %v for a stalled upstream", elapsed)
+	}
+	if !strings.Contains(logs.String(), "upstream request failed") {
+		t.Errorf("Expected the upstream error to be logged, got %q", logs.String())
+	}
+}
+
+// TestReverseProxyHandlerRemoteAddr tests that a request proxied over a real
+// connection reaches the upstream with the client's address forwarded
+func TestReverseProxyHandlerRemoteAddr(t *testing.T) {
+	forwarded := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Forwarded-For")
+	}))
+	defer upstream.Close()
+
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/api", &ReverseProxyHandler{Upstream: upstream.URL, Logger: server.Logger})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ListenAndServe(ctx)
+
+	var addr net.Addr
+	deadline := time.Now().Add(2 * time.Second)
+	for addr == nil && time.Now().Before(deadline) {
+		addr = server.ListenerAddr()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("ListenerAddr() returned nil after server start")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /api HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if _, _, _, err := readTestResponse(bufio.NewReader(conn)); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if got := <-forwarded; got != "127.0.0.1" {
+		t.Errorf("Upstream saw X-Forwarded-For %q, want 127.0.0.1", got)
+	}
+}
+
+func TestUploadHandlerResumable(t *testing.T) {
+	uploadDir := t.TempDir()
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.(*HTTPRouter).AddMethodRoute("PUT", "/uploads/video.bin", &UploadHandler{Directory: uploadDir})
+
+	content := strings.Repeat("0123456789abcdef", 64)
+	put := func(contentRange string, body string) (string, map[string]string) {
+		raw := "PUT /uploads/video.bin HTTP/1.1\r\nHost: localhost\r\n"
+		if contentRange != "" {
+			raw += "Content-Range: " + contentRange + "\r\n"
+		}
+		raw += fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)) + body
+
+		status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return strings.Fields(status)[1], headers
+	}
+	finalPath := filepath.Join(uploadDir, "uploads", "video.bin")
+	total := len(content)
+
+	status, headers := put(fmt.Sprintf("bytes 0-399/%d", total), content[:400])
+	if status != "202" || headers["Range"] != "bytes=0-399" {
+		t.Fatalf("First piece: status %s, Range %q, want 202 and bytes=0-399", status, headers["Range"])
+	}
+	if _, err := os.Stat(finalPath); !os.IsNotExist(err) {
+		t.Error("The file should not exist before the upload completes")
+	}
+
+	// A piece past the received bytes leaves a gap and is refused
+	status, headers = put(fmt.Sprintf("bytes 600-%d/%d", total-1, total), content[600:])
+	if status != "416" || headers["Range"] != "bytes=0-399" {
+		t.Errorf("Gap: status %s, Range %q, want 416 and bytes=0-399", status, headers["Range"])
+	}
+
+	// A client that lost track asks where to resume
+	status, headers = put(fmt.Sprintf("bytes */%d", total), "")
+	if status != "202" || headers["Range"] != "bytes=0-399" {
+		t.Errorf("Progress query: status %s, Range %q, want 202 and bytes=0-399", status, headers["Range"])
+	}
+
+	// Resuming with some overlap completes the upload
+	status, _ = put(fmt.Sprintf("bytes 300-%d/%d", total-1, total), content[300:])
+	if status != "201" {
+		t.Fatalf("Last piece: status %s, want 201", status)
+	}
+	got, err := os.ReadFile(finalPath)
+	if err != nil {
+		t.Fatalf("Failed to read the uploaded file: %v", err)
+	}
+	if string(got) != content {
+		t.Errorf("Assembled file differs from the upload (%d bytes, want %d)", len(got), total)
+	}
+	if _, err := os.Stat(finalPath + ".part"); !os.IsNotExist(err) {
+		t.Error("The partial file should be gone after completion")
+	}
+
+	for _, tt := range []struct {
+		name         string
+		contentRange string
+		body         string
+	}{
+		{"length mismatch", "bytes 0-9/20", "short"},
+		{"last beyond total", "bytes 0-4/4", "hello"},
+		{"not bytes", "items 0-4/5", "hello"},
+	} {
+		if status, _ := put(tt.contentRange, tt.body); status != "400" {
+			t.Errorf("%s: status %s, want 400", tt.name, status)
+		}
+	}
+}
+
+// TestUploadHandlerSymlinks tests that uploads can't be written outside the
+// directory through symlinks
+func TestUploadHandlerSymlinks(t *testing.T) {
+	uploadDir, elsewhere := t.TempDir(), t.TempDir()
+	if err := os.Symlink(elsewhere, filepath.Join(uploadDir, "link")); err != nil {
+		t.Skipf("Symlinks unavailable: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(elsewhere, "target.txt"), filepath.Join(uploadDir, "file.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(elsewhere, "part.txt"), filepath.Join(uploadDir, "partial.txt.part")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	handler := &UploadHandler{Directory: uploadDir}
+	for _, target := range []string{"/link/pwned.txt", "/link/sub/dir/pwned.txt", "/file.txt", "/partial.txt"} {
+		req := &Request{Method: "PUT", Path: target, Protocol: "HTTP/1.1", Headers: map[string]string{}, Body: []byte("payload")}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("PUT %s: unexpected error: %v", target, err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("PUT %s = %d, want 403", target, resp.StatusCode)
+		}
+	}
+
+	entries, err := os.ReadDir(elsewhere)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Files were written outside the upload directory: %v", entries)
+	}
+
+	// Links that stay inside the directory are fine
+	if err := os.Mkdir(filepath.Join(uploadDir, "real"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink("real", filepath.Join(uploadDir, "alias")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	req := &Request{Method: "PUT", Path: "/alias/ok.txt", Protocol: "HTTP/1.1", Headers: map[string]string{}, Body: []byte("payload")}
+	if resp, err := handler.Handle()(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT through an internal link = %v, %v, want 201", resp, err)
+	}
+}
+
+func TestZipHandler(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	files := map[string]string{
+		"docs/readme.txt":       "read me",
+		"docs/guide/intro.md":   "# Intro",
+		"docs/guide/setup.md":   "# Setup",
+		"private/secret.txt":    "not in the archive",
+		"docs-other/ignore.txt": "other directory",
+	}
+	for name, content := range files {
+		fullPath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("outside"), 0644); err != nil {
+		t.Fatalf("Failed to create outside file: %v", err)
+	}
+	// One link stays inside the root, the others escape it
+	if err := os.Symlink(filepath.Join(root, "private", "secret.txt"), filepath.Join(root, "docs", "linked.txt")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "docs", "escape.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", root, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute(`^/download/.+\.zip$`, &ZipHandler{Directory: root, Prefix: "/download/", Logger: server.Logger})
+
+	get := func(target string) *http.Response {
+		out := server.ServeRaw([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return resp
+	}
+
+	resp := get("/download/docs.zip")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q, want application/zip", got)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename=docs.zip` {
+		t.Errorf("Content-Disposition = %q, want attachment; filename=docs.zip", got)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Response is not a zip archive: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, file := range archive.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		got[file.Name] = string(data)
+	}
+	want := map[string]string{
+		"readme.txt":     "read me",
+		"guide/intro.md": "# Intro",
+		"guide/setup.md": "# Setup",
+		"linked.txt":     "not in the archive",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Archive holds %v, want %v", got, want)
+	}
+
+	for _, target := range []string{
+		"/download/missing.zip",
+		"/download/docs/readme.txt.zip",
+		"/download/escape.zip",
+		"/download/..%2F..%2Fetc.zip",
+	} {
+		if resp := get(target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", target, resp.StatusCode)
+		}
+	}
+
+	// Without a Logger, the skipped symlink is logged to the default logger
+	plain := &ZipHandler{Directory: root, Prefix: "/download/"}
+	zipResp, err := plain.Handle()(&Request{Method: "GET", Path: "/download/docs.zip", Protocol: "HTTP/1.1", Headers: map[string]string{}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(zipResp.Reader)
+	zipResp.Reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Errorf("Response is not a zip archive: %v", err)
+	}
+}
+
+func TestSingleFileHandler(t *testing.T) {
+	// Keep the file outside the document root to show the layout doesn't matter
+	docRoot := t.TempDir()
+	robotsPath := filepath.Join(t.TempDir(), "robots-production.txt")
+	robotsContent := "User-agent: *\nDisallow: /private/\n"
+	if err := os.WriteFile(robotsPath, []byte(robotsContent), 0644); err != nil {
+		t.Fatalf("Failed to create robots file: %v", err)
+	}
+
+	modTime := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(robotsPath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	server := NewHTTPServer("127.0.0.1:0", docRoot, logger)
+	server.Router.AddRoute("/robots.txt", &SingleFileHandler{Path: robotsPath, Logger: logger})
+	server.Router.AddRoute("/missing.txt", &SingleFileHandler{Path: filepath.Join(docRoot, "nope.txt"), Logger: logger})
+
+	tests := []struct {
+		name           string
+		path           string
+		headers        map[string]string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"serves the file", "/robots.txt", nil, 200, robotsContent},
+		{"precondition failed", "/robots.txt", map[string]string{
+			"If-Unmodified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat),
+		}, 412, ""},
+		{"missing file", "/missing.txt", nil, 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(map[string]string)
+			for k, v := range tt.headers {
+				headers[k] = v
+			}
+
+			req := &Request{
+				Method:   "GET",
+				Path:     tt.path,
+				Protocol: "HTTP/1.1",
+				Headers:  headers,
+			}
+
+			resp := server.handleRequest(req)
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("StatusCode = %v, want %v", resp.StatusCode, tt.expectedStatus)
+			}
+
+			if tt.expectedStatus == 200 {
+				if string(resp.Body) != tt.expectedBody {
+					t.Errorf("Body = %q, want %q", string(resp.Body), tt.expectedBody)
+				}
+				if resp.Headers["Content-Type"] != "text/plain; charset=utf-8" {
+					t.Errorf("Content-Type = %v, want text/plain; charset=utf-8", resp.Headers["Content-Type"])
+				}
+				if resp.Headers["Last-Modified"] != modTime.Format(http.TimeFormat) {
+					t.Errorf("Last-Modified = %v, want %v", resp.Headers["Last-Modified"], modTime.Format(http.TimeFormat))
+				}
+			}
+		})
+	}
+}
+
+func TestFileHandlerDigest(t *testing.T) {
+	tempDir := t.TempDir()
+	content := []byte("integrity matters")
+	if err := os.WriteFile(filepath.Join(tempDir, "file.txt"), content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+
+	tests := []struct {
+		algorithm string
+		header    string
+		expected  string
+	}{
+		{DigestSHA256, "Digest", "sha-256=" + base64.StdEncoding.EncodeToString(sha[:])},
+		{DigestMD5, "Content-MD5", base64.StdEncoding.EncodeToString(md[:])},
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			handler := &FileHandler{
+				FileDirectory:   tempDir,
+				Logger:          logger,
+				DigestAlgorithm: tt.algorithm,
+			}
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/file.txt",
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.Headers[tt.header] != tt.expected {
+				t.Errorf("%s = %q, want %q", tt.header, resp.Headers[tt.header], tt.expected)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		handler := &FileHandler{FileDirectory: tempDir, Logger: logger}
+		req := &Request{Method: "GET", Path: "/file.txt", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, exists := resp.Headers["Digest"]; exists {
+			t.Error("Did not expect Digest header when disabled")
+		}
+	})
+}
+
+func TestFileHandlerDigestStreamed(t *testing.T) {
+	tempDir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 128*1024) // 2MB, above the streaming threshold
+	if err := os.WriteFile(filepath.Join(tempDir, "large.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	expected := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	handler := &FileHandler{
+		FileDirectory:   tempDir,
+		Logger:          slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		DigestAlgorithm: DigestSHA256,
+	}
+
+	fetch := func() *Response {
+		req := &Request{Method: "GET", Path: "/large.bin", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Reader == nil {
+			t.Fatal("Expected a streamed response")
+		}
+		return resp
+	}
+
+	// The first transfer computes the digest while streaming
+	first := fetch()
+	if _, exists := first.Headers["Digest"]; exists {
+		t.Error("Did not expect Digest before the file was streamed once")
+	}
+	streamed, err := io.ReadAll(first.Reader)
+	if err != nil {
+		t.Fatalf("Failed to stream file: %v", err)
+	}
+	first.Reader.Close()
+	if !bytes.Equal(streamed, content) {
+		t.Fatal("Streamed content doesn't match file")
+	}
+
+	// Later transfers reuse it without reading the file twice
+	second := fetch()
+	defer second.Reader.Close()
+	if second.Headers["Digest"] != expected {
+		t.Errorf("Digest = %q, want %q", second.Headers["Digest"], expected)
+	}
+	if _, ok := second.Reader.(*os.File); !ok {
+		t.Errorf("Expected the cached digest to skip hashing, got reader %T", second.Reader)
+	}
+
+	// A changed file is hashed again, replacing the old digest
+	if err := os.WriteFile(filepath.Join(tempDir, "large.bin"), append(content, '!'), 0644); err != nil {
+		t.Fatalf("Failed to update test file: %v", err)
+	}
+	third := fetch()
+	if _, exists := third.Headers["Digest"]; exists {
+		t.Error("Did not expect the old Digest for a changed file")
+	}
+	io.Copy(io.Discard, third.Reader)
+	third.Reader.Close()
+
+	entries := 0
+	handler.digests.Range(func(key, value any) bool {
+		entries++
+		return true
+	})
+	if entries != 1 {
+		t.Errorf("Digest cache holds %d entries, want 1 per file", entries)
+	}
+}
+
+// TestFileHandlerSharedReads tests that concurrent requests for one file share a single read
+func TestFileHandlerSharedReads(t *testing.T) {
+	tempDir := t.TempDir()
+	// Files under smallFileBytes are read directly, so this one is larger
+	content := "<h1>popular page</h1>" + strings.Repeat("<p>paragraph</p>\n", smallFileBytes/16)
+	if err := os.WriteFile(filepath.Join(tempDir, "popular.html"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	var reads atomic.Int32
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		readFile: func(name string) ([]byte, error) {
+			reads.Add(1)
+			// Hold the read open so the other requests arrive while it runs
+			time.Sleep(100 * time.Millisecond)
+			return os.ReadFile(name)
+		},
+	}
+
+	fetch := func() (string, error) {
+		req := &Request{Method: "GET", Path: "/popular.html", Protocol: "HTTP/1.1", Headers: map[string]string{}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			return "", err
+		}
+		return string(resp.Body), nil
+	}
+
+	const clients = 20
+	start := make(chan struct{})
+	bodies := make(chan string, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			body, err := fetch()
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			bodies <- body
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != content {
+			t.Errorf("Body = %q, want %q", body, content)
+		}
+	}
+	if n := reads.Load(); n != 1 {
+		t.Errorf("File was read %d times for concurrent requests, want 1", n)
+	}
+
+	// Nothing is kept once the read is done, a later request reads again
+	if _, err := fetch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := reads.Load(); n != 2 {
+		t.Errorf("File was read %d times after a later request, want 2", n)
+	}
+}
+
+func TestReadSmallFile(t *testing.T) {
+	tempDir := t.TempDir()
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"tiny", 21},
+		{"just under buffer", smallFileBytes - 1},
+		{"exactly buffer", smallFileBytes},
+		{"grown past buffer", smallFileBytes*2 + 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, tt.size)
+			for i := range content {
+				content[i] = byte('a' + i%26)
+			}
+			name := filepath.Join(tempDir, strings.ReplaceAll(tt.name, " ", "-"))
+			if err := os.WriteFile(name, content, 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			data, err := readSmallFile(name)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("Read %d bytes, want the %d written", len(data), len(content))
+			}
+		})
+	}
+
+	if _, err := readSmallFile(filepath.Join(tempDir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Missing file error = %v, want not exist", err)
+	}
+
+	// Bodies served from the pooled buffer mustn't change when it's reused
+	if err := os.WriteFile(filepath.Join(tempDir, "a.txt"), []byte("first file"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "b.txt"), []byte("second"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	fetch := func(path string) *Response {
+		resp, err := handler.Handle()(&Request{Method: "GET", Path: path, Protocol: "HTTP/1.1", Headers: map[string]string{}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+	first := fetch("/a.txt")
+	second := fetch("/b.txt")
+	if string(first.Body) != "first file" || string(second.Body) != "second" {
+		t.Errorf("Bodies = %q, %q, want %q, %q", first.Body, second.Body, "first file", "second")
+	}
+	if first.Reader != nil || first.Headers["Content-Length"] != "10" {
+		t.Errorf("Small file should be served from memory with Content-Length 10, got reader %v, length %q",
+			first.Reader, first.Headers["Content-Length"])
+	}
+}
+
+// BenchmarkSmallFileRead compares reading a small file through the pooled
+// buffer with the os.ReadFile and readShared paths it replaces
+func BenchmarkSmallFileRead(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "style.css")
+	content := bytes.Repeat([]byte("body { margin: 0; }\n"), 100)
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		b.Fatalf("Failed to create test file: %v", err)
+	}
+
+	b.Run("ReadFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := os.ReadFile(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Shared", func(b *testing.B) {
+		handler := &FileHandler{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := handler.readShared(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := readSmallFile(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestFileHandlerMaxConcurrentStreams tests that transfers beyond the limit
+// wait until an earlier one has finished
+func TestFileHandlerMaxConcurrentStreams(t *testing.T) {
+	tempDir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 128*1024) // 2MB, above the streaming threshold
+	if err := os.WriteFile(filepath.Join(tempDir, "large.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory:        tempDir,
+		Logger:               slog.New(slog.NewTextHandler(io.Discard, nil)),
+		MaxConcurrentStreams: 1,
+	}
+
+	fetch := func(headers map[string]string) *Response {
+		req := &Request{Method: "GET", Path: "/large.bin", Protocol: "HTTP/1.1", Headers: headers}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			return nil
+		}
+		return resp
+	}
+
+	first := fetch(map[string]string{})
+	if first == nil || first.Reader == nil {
+		t.Fatal("Expected a streamed response")
+	}
+
+	// Ranges hold the file open too, so they queue behind the first transfer
+	for _, headers := range []map[string]string{{}, {"Range": "bytes=0-9"}, {"Range": "bytes=0-9,20-29"}} {
+		queued := make(chan *Response, 1)
+		go func() { queued <- fetch(headers) }()
+
+		select {
+		case <-queued:
+			t.Fatalf("Transfer with %v started while the limit was reached", headers)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		streamed, err := io.ReadAll(first.Reader)
+		if err != nil {
+			t.Fatalf("Failed to stream file: %v", err)
+		}
+		first.Reader.Close()
+		if len(streamed) == 0 {
+			t.Fatal("Expected the streamed transfer to have a body")
+		}
+
+		select {
+		case first = <-queued:
+			if first == nil || first.Reader == nil {
+				t.Fatal("Expected a streamed response")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Transfer with %v didn't start after the first one finished", headers)
+		}
+	}
+	first.Reader.Close()
+
+	// Small files are buffered and never wait for a slot
+	if err := os.WriteFile(filepath.Join(tempDir, "small.txt"), []byte("small"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	held := fetch(map[string]string{})
+	defer held.Reader.Close()
+	req := &Request{Method: "GET", Path: "/small.txt", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+	if resp, err := handler.Handle()(req); err != nil || string(resp.Body) != "small" {
+		t.Errorf("Expected the small file to be served while the limit is reached, got %v", err)
+	}
+
+	// Nor do HEAD requests, which never read the file
+	head := &Request{Method: "HEAD", Path: "/large.bin", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+	if resp, err := handler.Handle()(head); err != nil || resp.StatusCode != 200 {
+		t.Errorf("Expected HEAD to be answered while the limit is reached, got %v", err)
+	} else if resp.Reader != nil {
+		resp.Reader.Close()
+	}
+
+	// A slot held past StreamWait turns the waiting request away
+	handler.StreamWait = 50 * time.Millisecond
+	done := make(chan *Response, 1)
+	go func() { done <- fetch(map[string]string{}) }()
+	select {
+	case resp := <-done:
+		if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Headers["Retry-After"] == "" {
+			t.Errorf("Expected a 503 with Retry-After, got %+v", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Request waiting for a held slot didn't return")
+	}
+}
+
+func TestFileHandlerCacheGzip(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "app.js")
+	content := strings.Repeat("console.log('cached');\n", 500)
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	var logs bytes.Buffer
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		CacheGzip:     true,
+	}
+
+	fetch := func(acceptEncoding string) *Response {
+		req := &Request{Method: "GET", Path: "/app.js", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": acceptEncoding}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+	decompress := func(body []byte) string {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create gzip reader: %v", err)
+		}
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("Failed to decompress body: %v", err)
+		}
+		return string(data)
+	}
+
+	first := fetch("gzip")
+	second := fetch("gzip")
+	for i, resp := range []*Response{first, second} {
+		if resp.Headers["Content-Encoding"] != "gzip" {
+			t.Fatalf("request %d: Content-Encoding = %q, want gzip", i+1, resp.Headers["Content-Encoding"])
+		}
+		if resp.Headers["Content-Length"] != strconv.Itoa(len(resp.Body)) {
+			t.Errorf("request %d: Content-Length = %q, want %d", i+1, resp.Headers["Content-Length"], len(resp.Body))
+		}
+		if resp.Reader != nil {
+			t.Errorf("request %d: expected a buffered body, not a stream", i+1)
+		}
+	}
+	if &second.Body[0] != &first.Body[0] {
+		t.Error("Expected the second request to reuse the cached compressed bytes")
+	}
+	if decompress(second.Body) != content {
+		t.Error("Cached body doesn't decompress to the file")
+	}
+	if !strings.Contains(logs.String(), "cache_hit=false") || !strings.Contains(logs.String(), "cache_hit=true") {
+		t.Errorf("Expected a cache miss then a hit in the logs:\n%s", logs.String())
+	}
+
+	// Clients without gzip get the file itself
+	plain := fetch("")
+	if plain.Headers["Content-Encoding"] != "" || string(plain.Body) != content {
+		t.Errorf("Expected an uncompressed response, got Content-Encoding %q", plain.Headers["Content-Encoding"])
+	}
+
+	// The gzip copy has its own tag, which revalidates it
+	if first.Headers["ETag"] != gzipETag(plain.Headers["ETag"]) || !strings.HasSuffix(first.Headers["ETag"], `-gzip"`) {
+		t.Errorf("Gzip ETag = %q, want the file's %q with a -gzip suffix", first.Headers["ETag"], plain.Headers["ETag"])
+	}
+	req := &Request{Method: "GET", Path: "/app.js", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": "gzip", "If-None-Match": first.Headers["ETag"]}}
+	resp, err := handler.Handle()(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotModified || resp.Headers["ETag"] != first.Headers["ETag"] {
+		t.Errorf("Got %d with ETag %q, want 304 with the gzip tag", resp.StatusCode, resp.Headers["ETag"])
+	}
+
+	// Changing the file replaces the cached copy
+	updated := strings.Repeat("console.log('updated');\n", 500)
+	if err := os.WriteFile(filePath, []byte(updated), 0644); err != nil {
+		t.Fatalf("Failed to update test file: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filePath, later, later); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+	if got := decompress(fetch("gzip").Body); got != updated {
+		t.Error("Expected the cache to be refreshed after the file changed")
+	}
+}
+
+// TestFileHandlerGzipCacheBytes tests that the gzip cache stays within its
+// size limit by dropping the least recently used copies
+func TestFileHandlerGzipCacheBytes(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a.js", "b.js", "c.js"} {
+		content := strings.Repeat("console.log('"+name+"');\n", 500)
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	var logs bytes.Buffer
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		CacheGzip:     true,
+	}
+	fetch := func(path string) bool {
+		logs.Reset()
+		req := &Request{Method: "GET", Path: path, Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": "gzip"}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Headers["Content-Encoding"] != "gzip" {
+			t.Fatalf("%s: Content-Encoding = %q, want gzip", path, resp.Headers["Content-Encoding"])
+		}
+		return strings.Contains(logs.String(), "cache_hit=true")
+	}
+
+	// Room for two copies: fetch a and b, touch a, then c pushes out b
+	fetch("/a.js")
+	entry, _ := handler.cachedGzip(filepath.Join(tempDir, "a.js"))
+	handler.GzipCacheBytes = 2*entry.cost() + entry.cost()/2
+	fetch("/b.js")
+	if !fetch("/a.js") {
+		t.Error("Expected a.js to be cached")
+	}
+	fetch("/c.js")
+
+	if handler.gzipBytes > handler.GzipCacheBytes {
+		t.Errorf("Cache holds %d bytes, over its %d limit", handler.gzipBytes, handler.GzipCacheBytes)
+	}
+	if len(handler.gzipCache) != 2 {
+		t.Errorf("Cache holds %d copies, want 2", len(handler.gzipCache))
+	}
+	if !fetch("/a.js") {
+		t.Error("Expected the recently used a.js to stay cached")
+	}
+	if fetch("/b.js") {
+		t.Error("Expected the least recently used b.js to be dropped")
+	}
+}
+
+// TestFileHandlerCacheTTL tests that cached copies expire even when the
+// file's metadata is unchanged
+func TestFileHandlerCacheTTL(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "app.js")
+	original := strings.Repeat("console.log('before');\n", 500)
+	if err := os.WriteFile(filePath, []byte(original), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		CacheGzip:     true,
+		CacheTTL:      50 * time.Millisecond,
+	}
+
+	fetch := func() string {
+		req := &Request{Method: "GET", Path: "/app.js", Protocol: "HTTP/1.1", Headers: map[string]string{"Accept-Encoding": "gzip"}}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(resp.Body))
+		if err != nil {
+			t.Fatalf("Failed to create gzip reader: %v", err)
+		}
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("Failed to decompress body: %v", err)
+		}
+		return string(data)
+	}
+
+	if got := fetch(); got != original {
+		t.Fatal("First request didn't serve the file")
+	}
+
+	// Same size and modtime, so only the TTL can tell the copy is stale
+	edited := strings.Repeat("console.log('after!');\n", 500)
+	if err := os.WriteFile(filePath, []byte(edited), 0644); err != nil {
+		t.Fatalf("Failed to edit test file: %v", err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to restore modification time: %v", err)
+	}
+
+	if got := fetch(); got != original {
+		t.Error("Expected the cached copy before the TTL passed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := fetch(); got != edited {
+		t.Error("Expected the file to be re-read after the TTL passed")
+	}
+}
+
+func TestFileHandlerTemplateMode(t *testing.T) {
+	root := t.TempDir()
+	tempDir := filepath.Join(root, "site")
+	files := map[string]string{
+		"partials/header.html": "<header>{{include \"nav.html\"}}</header>",
+		"partials/nav.html":    "<nav>home</nav>",
+		"page.html":            "{{include \"/partials/header.html\"}}<main>body</main>",
+		"loop-a.html":          "a{{include \"loop-b.html\"}}",
+		"loop-b.html":          "b{{include \"loop-a.html\"}}",
+		"self.html":            "{{ include \"self.html\" }}",
+		"escape.html":          "{{include \"../secret.html\"}}",
+		"missing.html":         "{{include \"nope.html\"}}",
+		"plain.txt":            "{{include \"partials/nav.html\"}}",
+	}
+	for name, content := range files {
+		fullPath := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.html"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		templateMode bool
+		expectedBody string
+		expectedErr  error
+	}{
+		{"nested includes", "/page.html", true, "<header><nav>home</nav></header><main>body</main>", nil},
+		{"disabled", "/page.html", false, files["page.html"], nil},
+		{"non-html file", "/plain.txt", true, files["plain.txt"], nil},
+		{"recursive include", "/loop-a.html", true, "", errIncludeRecursion},
+		{"self include", "/self.html", true, "", errIncludeRecursion},
+		{"outside root", "/escape.html", true, "", errIncludeOutsideRoot},
+		{"missing include", "/missing.html", true, "", os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &FileHandler{
+				FileDirectory: tempDir,
+				Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				TemplateMode:  tt.templateMode,
+			}
+
+			req := &Request{
+				Method:   "GET",
+				Path:     tt.path,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := handler.Handle()(req)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("Expected error %v, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", resp.Body, tt.expectedBody)
+			}
+			if resp.Headers["Content-Length"] != fmt.Sprintf("%d", len(tt.expectedBody)) {
+				t.Errorf("Content-Length = %s, want %d", resp.Headers["Content-Length"], len(tt.expectedBody))
+			}
+		})
+	}
+}
+
+func TestFileHandlerDirectoryListing(t *testing.T) {
+	tempDir := t.TempDir()
+	listDir := filepath.Join(tempDir, "files")
+	if err := os.MkdirAll(filepath.Join(listDir, "sub dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		name := filepath.Join(listDir, fmt.Sprintf("entry-%03d.txt", i))
+		if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(listDir, "<b>.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("disabled", func(t *testing.T) {
+		handler := &FileHandler{FileDirectory: tempDir, Logger: logger}
+		req := &Request{Method: "GET", Path: "/files/", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.StatusCode != 404 {
+			t.Errorf("Expected 404 without listing enabled, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		handler := &FileHandler{FileDirectory: tempDir, Logger: logger, EnableDirectoryListing: true}
+		req := &Request{Method: "GET", Path: "/files", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected 200, got %d", resp.StatusCode)
+		}
+		if resp.Headers["Content-Type"] != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q, want text/html", resp.Headers["Content-Type"])
+		}
+		if _, exists := resp.Headers["Content-Encoding"]; exists {
+			t.Error("Listing should leave Content-Encoding to the middleware")
+		}
+
+		body := string(resp.Body)
+		for _, want := range []string{
+			`<a href="/files/entry-007.txt">entry-007.txt</a>`,
+			`<a href="/files/sub%20dir/">sub dir/</a>`,
+			`<a href="/files/%3Cb%3E.txt">&lt;b&gt;.txt</a>`,
+			`<a href="/">../</a>`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Listing missing %s", want)
+			}
+		}
+	})
+
+	t.Run("sizes and dates", func(t *testing.T) {
+		known := filepath.Join(listDir, "known.bin")
+		if err := os.WriteFile(known, make([]byte, 1536), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		defer os.Remove(known)
+		modTime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		if err := os.Chtimes(known, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+
+		handler := &FileHandler{FileDirectory: tempDir, Logger: logger, EnableDirectoryListing: true}
+		req := &Request{Method: "GET", Path: "/files/", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		want := `<a href="/files/known.bin">known.bin</a></td><td>2024-03-01 12:30</td><td>1.5 KB</td>`
+		if !strings.Contains(string(resp.Body), want) {
+			t.Errorf("Listing missing %s", want)
+		}
+		if !strings.Contains(string(resp.Body), `<a href="/files/sub%20dir/">sub dir/</a></td><td>`) {
+			t.Error("Listing missing the subdirectory row")
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		handler := &FileHandler{FileDirectory: tempDir, Logger: logger, EnableDirectoryListing: true}
+		req := &Request{
+			Method:   "GET",
+			Path:     "/files/",
+			Protocol: "HTTP/1.1",
+			Headers:  map[string]string{"Accept-Encoding": "gzip"},
+		}
+
+		resp, err := GzipMiddleware(handler.Handle())(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp.Headers["Content-Encoding"] != "gzip" {
+			t.Fatalf("Expected gzip-compressed listing, got Content-Encoding %q", resp.Headers["Content-Encoding"])
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(resp.Body))
+		if err != nil {
+			t.Fatalf("Failed to create gzip reader: %v", err)
+		}
+		decompressed, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("Failed to decompress listing: %v", err)
+		}
+		if !strings.Contains(string(decompressed), "entry-199.txt") {
+			t.Error("Decompressed listing is missing entries")
+		}
+	})
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{5 * 1024 * 1024, "5.0 MB"},
+		{3 << 40, "3.0 TB"},
+		{2048 << 40, "2048.0 TB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatSize(tt.size); got != tt.expected {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.size, got, tt.expected)
+		}
+	}
+}
+
+func TestFileHandlerIfNoneMatch(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "cached.txt"), []byte("cache me"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	fetch := func(method, ifNoneMatch string) *Response {
+		req := &Request{
+			Method:   method,
+			Path:     "/cached.txt",
+			Protocol: "HTTP/1.1",
+			Headers:  make(map[string]string),
+		}
+		if ifNoneMatch != "" {
+			req.Headers["If-None-Match"] = ifNoneMatch
+		}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	etag := fetch("GET", "").Headers["ETag"]
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("Expected a quoted strong ETag, got %q", etag)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		ifNoneMatch    string
+		expectedStatus int
+	}{
+		{"exact tag", "GET", etag, 304},
+		{"list containing tag", "GET", `"other", ` + etag + `, "another"`, 304},
+		{"weak tag", "GET", "W/" + etag, 304},
+		{"wildcard", "GET", "*", 304},
+		{"head request", "HEAD", etag, 304},
+		{"no match", "GET", `"stale", W/"older"`, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := fetch(tt.method, tt.ifNoneMatch)
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if resp.Headers["ETag"] != etag {
+				t.Errorf("ETag = %q, want %q", resp.Headers["ETag"], etag)
+			}
+			if tt.expectedStatus == 304 && (len(resp.Body) != 0 || resp.Reader != nil) {
+				t.Error("304 response must not have a body")
+			}
+		})
+	}
+}
+
+func TestFileHandlerWeakETags(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "large.bin")
+	if err := os.WriteFile(filePath, []byte("pretend this is huge"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	modTime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WeakETags:     true,
+	}
+
+	fetch := func(ifNoneMatch string) *Response {
+		req := &Request{Method: "GET", Path: "/large.bin", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+		if ifNoneMatch != "" {
+			req.Headers["If-None-Match"] = ifNoneMatch
+		}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	etag := fetch("").Headers["ETag"]
+	expected := fmt.Sprintf(`W/"20-%d"`, modTime.UnixNano())
+	if etag != expected {
+		t.Fatalf("ETag = %q, want %q", etag, expected)
+	}
+	if resp := fetch(etag); resp.StatusCode != 304 {
+		t.Errorf("Expected 304 for the current weak tag, got %d", resp.StatusCode)
+	}
+
+	// Weak tags never satisfy If-Range, so the range is ignored
+	req := &Request{Method: "GET", Path: "/large.bin", Protocol: "HTTP/1.1", Headers: map[string]string{"If-Range": etag, "Range": "bytes=0-9"}}
+	rangeResp, err := handler.Handle()(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rangeResp.StatusCode != 200 {
+		t.Errorf("Expected 200 for a weak If-Range, got %d", rangeResp.StatusCode)
+	}
+
+	// Touching the file changes the tag even though its size doesn't
+	newModTime := modTime.Add(time.Hour)
+	if err := os.Chtimes(filePath, newModTime, newModTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+	resp := fetch(etag)
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected 200 for a stale weak tag, got %d", resp.StatusCode)
+	}
+	if resp.Headers["ETag"] == etag {
+		t.Errorf("Expected the ETag to change with the modification time, still %q", etag)
+	}
+}
+
+func TestFileHandlerCacheControlWithETag(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"page.html", "style.css"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("content"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	tests := []struct {
+		name                 string
+		path                 string
+		expectedCacheControl string
+	}{
+		{"html revalidates", "/page.html", "no-cache"},
+		{"asset is cached", "/style.css", "public, max-age=3600"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: "GET", Path: tt.path, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			etag := resp.Headers["ETag"]
+			if etag == "" {
+				t.Fatal("Expected an ETag")
+			}
+			if resp.Headers["Cache-Control"] != tt.expectedCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", resp.Headers["Cache-Control"], tt.expectedCacheControl)
+			}
+
+			// Revalidation with the ETag gets a 304 carrying the same policy
+			req.Headers["If-None-Match"] = etag
+			resp, err = handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.StatusCode != 304 {
+				t.Errorf("StatusCode = %d, want 304", resp.StatusCode)
+			}
+			if resp.Headers["Cache-Control"] != tt.expectedCacheControl {
+				t.Errorf("304 Cache-Control = %q, want %q", resp.Headers["Cache-Control"], tt.expectedCacheControl)
+			}
+		})
+	}
+}
+
+func TestFileHandlerRange(t *testing.T) {
+	tempDir := t.TempDir()
+	content := []byte("0123456789abcdefghij")
+	if err := os.WriteFile(filepath.Join(tempDir, "range.txt"), content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		MaxRanges:     2,
+	}
+
+	fetch := func(rangeHeader string) (*Response, []byte) {
+		req := &Request{
+			Method:   "GET",
+			Path:     "/range.txt",
+			Protocol: "HTTP/1.1",
+			Headers:  map[string]string{"Range": rangeHeader},
+		}
+		resp, err := handler.Handle()(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		body := resp.Body
+		if resp.Reader != nil {
+			defer resp.Reader.Close()
+			if body, err = io.ReadAll(resp.Reader); err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+		}
+		if resp.Headers["Content-Length"] != fmt.Sprintf("%d", len(body)) {
+			t.Errorf("Content-Length = %s, but body has %d bytes", resp.Headers["Content-Length"], len(body))
+		}
+		return resp, body
+	}
+
+	singleTests := []struct {
+		name          string
+		rangeHeader   string
+		expectedRange string
+		expectedBody  string
+	}{
+		{"closed range", "bytes=2-5", "bytes 2-5/20", "2345"},
+		{"open range", "bytes=15-", "bytes 15-19/20", "fghij"},
+		{"suffix range", "bytes=-3", "bytes 17-19/20", "hij"},
+		{"end past size", "bytes=18-100", "bytes 18-19/20", "ij"},
+	}
+
+	for _, tt := range singleTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetch(tt.rangeHeader)
+			if resp.StatusCode != 206 {
+				t.Fatalf("StatusCode = %d, want 206", resp.StatusCode)
+			}
+			if resp.Headers["Content-Range"] != tt.expectedRange {
+				t.Errorf("Content-Range = %q, want %q", resp.Headers["Content-Range"], tt.expectedRange)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", body, tt.expectedBody)
+			}
+		})
+	}
+
+	t.Run("two ranges", func(t *testing.T) {
+		resp, body := fetch("bytes=0-1, 10-12")
+		if resp.StatusCode != 206 {
+			t.Fatalf("StatusCode = %d, want 206", resp.StatusCode)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(resp.Headers["Content-Type"])
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("Content-Type = %q, want multipart/byteranges", resp.Headers["Content-Type"])
+		}
+
+		expected := []struct{ contentRange, data string }{
+			{"bytes 0-1/20", "01"},
+			{"bytes 10-12/20", "abc"},
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i, want := range expected {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("Failed to read part %d: %v", i, err)
+			}
+			if part.Header.Get("Content-Range") != want.contentRange {
+				t.Errorf("Part %d Content-Range = %q, want %q", i, part.Header.Get("Content-Range"), want.contentRange)
+			}
+			if part.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+				t.Errorf("Part %d Content-Type = %q", i, part.Header.Get("Content-Type"))
+			}
+			data, _ := io.ReadAll(part)
+			if string(data) != want.data {
+				t.Errorf("Part %d data = %q, want %q", i, data, want.data)
+			}
+		}
+		if _, err := reader.NextPart(); err != io.EOF {
+			t.Errorf("Expected 2 parts, got more (err %v)", err)
+		}
+	})
+
+	fullTests := []struct {
+		name        string
+		rangeHeader string
+	}{
+		{"over range cap", "bytes=0-1,3-4,6-7"},
+		{"malformed", "bytes=5-2"},
+		{"other unit", "items=0-1"},
+	}
+
+	for _, tt := range fullTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetch(tt.rangeHeader)
+			if resp.StatusCode != 200 {
+				t.Errorf("StatusCode = %d, want 200", resp.StatusCode)
+			}
+			if string(body) != string(content) {
+				t.Errorf("Expected the full file, got %q", body)
+			}
+		})
+	}
+
+	t.Run("unsatisfiable", func(t *testing.T) {
+		resp, _ := fetch("bytes=50-60")
+		if resp.StatusCode != 416 {
+			t.Errorf("StatusCode = %d, want 416", resp.StatusCode)
+		}
+		if resp.Headers["Content-Range"] != "bytes */20" {
+			t.Errorf("Content-Range = %q, want %q", resp.Headers["Content-Range"], "bytes */20")
+		}
+	})
+}
+
+func TestFileHandlerRootFallback(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		fallback       Handler
+		path           string
+		withIndex      bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"no fallback", nil, "/", false, 404, "404 Not Found"},
+		{"default message", &RootHandler{}, "/", false, 200, "Hello, World!"},
+		{"configured message", &RootHandler{Message: "Nothing here yet"}, "/", false, 200, "Nothing here yet"},
+		{"index wins", &RootHandler{}, "/", true, 200, "<h1>index</h1>"},
+		{"only for root", &RootHandler{}, "/missing.txt", false, 404, "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			if tt.withIndex {
+				if err := os.WriteFile(filepath.Join(tempDir, "index.html"), []byte("<h1>index</h1>"), 0644); err != nil {
+					t.Fatalf("Failed to create index: %v", err)
+				}
+			}
+
+			handler := &FileHandler{FileDirectory: tempDir, Logger: logger, RootFallback: tt.fallback}
+			req := &Request{Method: "GET", Path: tt.path, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", resp.Body, tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestFileHandlerFallbackSuffixes(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		"exact":                 "exact file",
+		"exact.html":            "exact html",
+		"about.html":            "about html",
+		"docs/index.html":       "docs index",
+		"both.html":             "both html",
+		"both/index.html":       "both index",
+		"empty/placeholder.txt": "placeholder",
+	}
+	for name, content := range files {
+		fullPath := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		suffixes       []string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"path itself first", CleanURLFallbacks, "/exact", 200, "exact file"},
+		{"html extension", CleanURLFallbacks, "/about", 200, "about html"},
+		{"directory index", CleanURLFallbacks, "/docs", 200, "docs index"},
+		{"suffixes in order", CleanURLFallbacks, "/both", 200, "both html"},
+		{"configured order", []string{"/index.html", ".html"}, "/both", 200, "both index"},
+		{"missing path", CleanURLFallbacks, "/missing", 404, "404 Not Found"},
+		{"directory without candidates", CleanURLFallbacks, "/empty", 404, "404 Not Found"},
+		{"disabled", nil, "/about", 404, "404 Not Found"},
+		{"suffix cannot escape root", []string{"/../../etc/passwd"}, "/about", 404, "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &FileHandler{FileDirectory: tempDir, Logger: logger, FallbackSuffixes: tt.suffixes}
+			req := &Request{Method: "GET", Path: tt.path, Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", resp.Body, tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestFileHandlerIfRange(t *testing.T) {
+	tempDir := t.TempDir()
+	content := []byte("0123456789")
+	filePath := filepath.Join(tempDir, "partial.bin")
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modtime: %v", err)
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("Failed to stat test file: %v", err)
+	}
+	etag := fileETag(fileInfo)
+
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	tests := []struct {
+		name           string
+		ifRange        string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"matching etag", etag, 206, "234"},
+		{"stale etag", `"stale-tag"`, 200, "0123456789"},
+		{"weak etag", "W/" + etag, 200, "0123456789"},
+		{"matching date", modTime.Format(http.TimeFormat), 206, "234"},
+		{"stale date", modTime.Add(-time.Hour).Format(http.TimeFormat), 200, "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     "/partial.bin",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Range":    "bytes=2-4",
+					"If-Range": tt.ifRange,
+				},
+			}
+
+			resp, err := handler.Handle()(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			body := resp.Body
+			if resp.Reader != nil {
+				defer resp.Reader.Close()
+				body, _ = io.ReadAll(resp.Reader)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", body, tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestFileHandlerLogAttributes(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "docs"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "docs", "guide.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	handler := &FileHandler{
+		FileDirectory: tempDir,
+		Logger:        slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/docs/guide.txt",
+		Protocol: "HTTP/1.1",
+		Headers:  map[string]string{"Range": "bytes=0-3"},
+	}
+	resp, err := handler.Handle()(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Reader.Close()
+
+	logOutput := buf.String()
+	for _, want := range []string{"file=/docs/guide.txt", "size=4", "file_size=10", `range="bytes=0-3"`} {
+		if !strings.Contains(logOutput, want) {
+			t.Errorf("Expected %q in log, got: %s", want, logOutput)
+		}
+	}
+	if strings.Contains(logOutput, tempDir) {
+		t.Errorf("Log leaks the document root path: %s", logOutput)
+	}
+
+	// A conditional request served from the client's cache is logged as a hit
+	buf.Reset()
+	req.Headers = map[string]string{"If-None-Match": resp.Headers["ETag"]}
+	if _, err := handler.Handle()(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "cache_hit=true") {
+		t.Errorf("Expected cache_hit=true in log, got: %s", buf.String())
+	}
+}
+
 func TestFileHandlerLargeFile(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping large file test in short mode")
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+// errInvalidPath is returned when a request target cannot be decoded
+var errInvalidPath = errors.New("invalid request path")
+
 // Request represents an HTTP request
 type Request struct {
 	Method     string
@@ -13,7 +19,12 @@ type Request struct {
 	Protocol   string
 	Headers    map[string]string
 	Body       []byte
-	RemoteAddr string // Client's remote address
+	RemoteAddr string            // Client's remote address
+	RawPath    string            // Original request target, set once Path has been decoded
+	Query      string            // Raw query string without the leading '?'
+	Params     map[string]string // Path parameters captured by TrieRouter
+	RawHead    []byte            // Request line and headers as received, if HTTPServer.KeepRawHead is set
+	BasePath   string            // Prefix stripped from Path by HTTPServer.BasePath, to prepend to links
 }
 
 // Response represents an HTTP response
@@ -24,6 +35,39 @@ type Response struct {
 	Headers    map[string]string
 	Body       []byte
 	Reader     io.ReadCloser // Add this field for streaming large files
+
+	// Trailers are sent after a chunked body. Their names are announced in a
+	// Trailer header up front; values may be filled in while Reader is read,
+	// e.g. a checksum computed over the streamed bytes.
+	Trailers map[string]string
+
+	uncompressedSize int64 // Body size before content encoding, set by GzipMiddleware
+}
+
+// decodeRequestTarget splits a raw request target into its percent-decoded path
+// and raw query. Segments are decoded one at a time and an encoded slash is kept
+// as "%2F", so decoding can never introduce a new path separator.
+func decodeRequestTarget(target string) (string, string, error) {
+	parsedURL, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errInvalidPath, err)
+	}
+
+	segments := strings.Split(parsedURL.EscapedPath(), "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %v", errInvalidPath, err)
+		}
+		segments[i] = strings.ReplaceAll(decoded, "/", "%2F")
+	}
+
+	decodedPath := strings.Join(segments, "/")
+	if strings.ContainsFunc(decodedPath, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+		return "", "", fmt.Errorf("%w: control character in path", errInvalidPath)
+	}
+
+	return decodedPath, parsedURL.RawQuery, nil
 }
 
 // Common HTTP status responses
@@ -45,11 +89,109 @@ func HTTP405MethodNotAllowed() *Response {
 	return response
 }
 
+// HTTP412PreconditionFailed returns a 412 Precondition Failed response
+func HTTP412PreconditionFailed() *Response {
+	return HTTPBaseResponse(http.StatusPreconditionFailed, http.StatusText(http.StatusPreconditionFailed))
+}
+
+// HTTP413RequestEntityTooLarge returns a 413 Request Entity Too Large response
+func HTTP413RequestEntityTooLarge() *Response {
+	return HTTPBaseResponse(http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+}
+
+// HTTP421MisdirectedRequest returns a 421 Misdirected Request response
+func HTTP421MisdirectedRequest() *Response {
+	return HTTPBaseResponse(http.StatusMisdirectedRequest, http.StatusText(http.StatusMisdirectedRequest))
+}
+
+// HTTP431RequestHeaderFieldsTooLarge returns a 431 Request Header Fields Too Large response
+func HTTP431RequestHeaderFieldsTooLarge() *Response {
+	return HTTPBaseResponse(http.StatusRequestHeaderFieldsTooLarge, http.StatusText(http.StatusRequestHeaderFieldsTooLarge))
+}
+
+// HTTP415UnsupportedMediaType returns a 415 Unsupported Media Type response
+func HTTP415UnsupportedMediaType() *Response {
+	return HTTPBaseResponse(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+}
+
+// HTTP416RangeNotSatisfiable returns a 416 Requested Range Not Satisfiable response
+func HTTP416RangeNotSatisfiable() *Response {
+	return HTTPBaseResponse(http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable))
+}
+
 // HTTP500InternalServerError returns a 500 Internal Server Error response
 func HTTP500InternalServerError() *Response {
 	return HTTPBaseResponse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 }
 
+// HTTP502BadGateway returns a 502 Bad Gateway response
+func HTTP502BadGateway() *Response {
+	return HTTPBaseResponse(http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+}
+
+// HTTP503ServiceUnavailable returns a 503 Service Unavailable response
+func HTTP503ServiceUnavailable() *Response {
+	return HTTPBaseResponse(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+}
+
+// HTTP505HTTPVersionNotSupported returns a 505 HTTP Version Not Supported response
+func HTTP505HTTPVersionNotSupported() *Response {
+	return HTTPBaseResponse(http.StatusHTTPVersionNotSupported, http.StatusText(http.StatusHTTPVersionNotSupported))
+}
+
+// StreamResponse returns a response that streams length bytes from r without
+// buffering them, e.g. for proxied or generated content. r is closed once the
+// response has been written; reads stop after length bytes so a longer
+// source can't corrupt the connection.
+func StreamResponse(status int, contentType string, length int64, r io.ReadCloser) *Response {
+	headers := copyHeaders(DefaultResponseHeaders)
+	headers["Content-Length"] = fmt.Sprintf("%d", length)
+	headers["Content-Type"] = contentType
+
+	return &Response{
+		StatusCode: status,
+		StatusText: http.StatusText(status),
+		Protocol:   "HTTP/1.1",
+		Headers:    headers,
+		Reader: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, length), r},
+	}
+}
+
+// ChunkedResponse returns a response that streams r with chunked transfer
+// coding, for bodies whose length isn't known up front. HTTP/1.0 clients
+// get the body delimited by closing the connection instead. r is closed
+// once the response has been written.
+func ChunkedResponse(status int, contentType string, r io.ReadCloser) *Response {
+	headers := copyHeaders(DefaultResponseHeaders)
+	headers["Content-Type"] = contentType
+
+	return &Response{
+		StatusCode: status,
+		StatusText: http.StatusText(status),
+		Protocol:   "HTTP/1.1",
+		Headers:    headers,
+		Reader:     r,
+	}
+}
+
+// unknownLength reports whether response streams a body without a Content-Length
+func unknownLength(response *Response) bool {
+	if response.Reader == nil || bodylessStatus(response.StatusCode) {
+		return false
+	}
+	_, ok := response.Headers["Content-Length"]
+	return !ok
+}
+
+// bodylessStatus reports whether responses with code must not have a body
+// (RFC 9110 section 6.4.1): informational, 204 No Content and 304 Not Modified
+func bodylessStatus(code int) bool {
+	return (code >= 100 && code < 200) || code == http.StatusNoContent || code == http.StatusNotModified
+}
+
 // HTTPBaseResponse creates a basic HTTP response with default headers
 func HTTPBaseResponse(statusCode int, statusText string) *Response {
 	body := []byte(fmt.Sprintf("%d %s", statusCode, statusText))
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -46,6 +51,56 @@ func TestHTTPResponses(t *testing.T) {
 				"Content-Type": "text/plain; charset=utf-8",
 			},
 		},
+		{
+			name:           "HTTP412PreconditionFailed",
+			responseFunc:   HTTP412PreconditionFailed,
+			expectedStatus: http.StatusPreconditionFailed,
+			expectedText:   http.StatusText(http.StatusPreconditionFailed),
+			expectedBody:   "412 Precondition Failed",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:           "HTTP413RequestEntityTooLarge",
+			responseFunc:   HTTP413RequestEntityTooLarge,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedText:   http.StatusText(http.StatusRequestEntityTooLarge),
+			expectedBody:   "413 Request Entity Too Large",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:           "HTTP416RangeNotSatisfiable",
+			responseFunc:   HTTP416RangeNotSatisfiable,
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+			expectedText:   http.StatusText(http.StatusRequestedRangeNotSatisfiable),
+			expectedBody:   "416 Requested Range Not Satisfiable",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:           "HTTP421MisdirectedRequest",
+			responseFunc:   HTTP421MisdirectedRequest,
+			expectedStatus: http.StatusMisdirectedRequest,
+			expectedText:   http.StatusText(http.StatusMisdirectedRequest),
+			expectedBody:   "421 Misdirected Request",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:           "HTTP431RequestHeaderFieldsTooLarge",
+			responseFunc:   HTTP431RequestHeaderFieldsTooLarge,
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+			expectedText:   http.StatusText(http.StatusRequestHeaderFieldsTooLarge),
+			expectedBody:   "431 Request Header Fields Too Large",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
 		{
 			name:           "HTTP500InternalServerError",
 			responseFunc:   HTTP500InternalServerError,
@@ -56,6 +111,26 @@ func TestHTTPResponses(t *testing.T) {
 				"Content-Type": "text/plain; charset=utf-8",
 			},
 		},
+		{
+			name:           "HTTP503ServiceUnavailable",
+			responseFunc:   HTTP503ServiceUnavailable,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedText:   http.StatusText(http.StatusServiceUnavailable),
+			expectedBody:   "503 Service Unavailable",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:           "HTTP505HTTPVersionNotSupported",
+			responseFunc:   HTTP505HTTPVersionNotSupported,
+			expectedStatus: http.StatusHTTPVersionNotSupported,
+			expectedText:   http.StatusText(http.StatusHTTPVersionNotSupported),
+			expectedBody:   "505 HTTP Version Not Supported",
+			checkHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -92,16 +167,21 @@ func TestHTTPResponses(t *testing.T) {
 			}
 
 			// Check default headers are present
-			defaultHeaders := []string{"Server", "Accept-Ranges", "Cache-Control", "Connection", "Content-Encoding"}
+			defaultHeaders := []string{"Server", "Cache-Control", "Connection", "Content-Encoding"}
 			for _, header := range defaultHeaders {
 				if _, ok := resp.Headers[header]; !ok {
 					t.Errorf("Missing default header %s", header)
 				}
 			}
 
+			// Error responses can't satisfy a range, so they mustn't advertise one
+			if _, ok := resp.Headers["Accept-Ranges"]; ok {
+				t.Error("Unexpected Accept-Ranges header on error response")
+			}
+
 			// Check Content-Length
-			// The actual lengths are: 400=15, 404=13, 405=22, 500=26
-			validLengths := []string{"13", "15", "22", "25", "26"}
+			// The actual lengths are: 400=15, 404=13, 405=22, 412=23, 413=28, 416=35, 421=23, 431=35, 500=26, 503=23, 505=30
+			validLengths := []string{"13", "15", "22", "23", "25", "26", "28", "30", "35"}
 			contentLength := resp.Headers["Content-Length"]
 			isValid := false
 			for _, valid := range validLengths {
@@ -117,6 +197,59 @@ func TestHTTPResponses(t *testing.T) {
 	}
 }
 
+// closeTrackingReader records whether it has been closed
+type closeTrackingReader struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (r *closeTrackingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestStreamResponse(t *testing.T) {
+	payload := bytes.Repeat([]byte("streamed "), 1000)
+	source := &closeTrackingReader{Reader: bytes.NewReader(payload)}
+
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/stream", HandlerFunc(func(req *Request) (*Response, error) {
+		return StreamResponse(http.StatusOK, "application/octet-stream", int64(len(payload)), source), nil
+	}))
+
+	out := server.ServeRaw([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("Expected 200 OK, got %q", status)
+	}
+	if headers["Content-Type"] != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", headers["Content-Type"])
+	}
+	if headers["Content-Length"] != fmt.Sprintf("%d", len(payload)) {
+		t.Errorf("Content-Length = %q, want %d", headers["Content-Length"], len(payload))
+	}
+	if !bytes.Equal(body, payload) {
+		t.Error("Streamed body doesn't match the source")
+	}
+	if !source.closed {
+		t.Error("Expected the source reader to be closed")
+	}
+
+	// A source longer than the announced length is cut off at the length
+	resp := StreamResponse(http.StatusOK, "text/plain", 3, io.NopCloser(strings.NewReader("abcdef")))
+	data, err := io.ReadAll(resp.Reader)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	if string(data) != "abc" {
+		t.Errorf("Expected stream limited to %q, got %q", "abc", data)
+	}
+}
+
 func TestHTTPBaseResponse(t *testing.T) {
 	tests := []struct {
 		name       string
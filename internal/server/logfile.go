@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// LogFile is an append-only log file that can be reopened after it has been
+// rotated, e.g. by logrotate followed by a SIGHUP
+type LogFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenLogFile opens path for appending, creating it if needed
+func OpenLogFile(path string) (*LogFile, error) {
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Write appends p to the current file handle
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	return f.file.Write(p)
+}
+
+// Reopen opens the path again and switches writes to the new handle. If the
+// file was moved away, a fresh one is created in its place.
+func (f *LogFile) Reopen() error {
+	file, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Close closes the current file handle
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// openAppend opens a file for appending, creating it if it doesn't exist
+func openAppend(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %s: %w", path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	tempDir := t.TempDir()
+	logPath := filepath.Join(tempDir, "access.log")
+	rotatedPath := filepath.Join(tempDir, "access.log.1")
+
+	logFile, err := OpenLogFile(logPath)
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	defer logFile.Close()
+
+	logger := slog.New(slog.NewTextHandler(logFile, nil))
+	handler := LoggingMiddleware(logger)(func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			Headers:    make(map[string]string),
+			Body:       []byte("ok"),
+		}, nil
+	})
+
+	serve := func(path string) {
+		req := &Request{
+			Method:   "GET",
+			Path:     path,
+			Protocol: "HTTP/1.1",
+			Headers:  make(map[string]string),
+		}
+		if _, err := handler(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	serve("/before-1")
+	serve("/before-2")
+
+	// Simulate logrotate moving the file away, then reopen
+	if err := os.Rename(logPath, rotatedPath); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	if err := logFile.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+
+	serve("/after")
+
+	rotated, err := os.ReadFile(rotatedPath)
+	if err != nil {
+		t.Fatalf("Failed to read rotated log: %v", err)
+	}
+	current, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read reopened log: %v", err)
+	}
+
+	if !strings.Contains(string(rotated), "/before-1") || !strings.Contains(string(rotated), "/before-2") {
+		t.Errorf("Rotated log missing earlier requests: %s", rotated)
+	}
+	if strings.Contains(string(rotated), "/after") {
+		t.Error("Rotated log should not receive writes after Reopen")
+	}
+	if !strings.Contains(string(current), "/after") {
+		t.Errorf("Reopened log missing new request: %s", current)
+	}
+	if strings.Contains(string(current), "/before") {
+		t.Error("Reopened log should only contain new requests")
+	}
+}
+
+func TestLogFileAppends(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(logPath, []byte("existing\n"), 0644); err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+
+	logFile, err := OpenLogFile(logPath)
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+
+	if _, err := logFile.Write([]byte("appended\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if string(content) != "existing\nappended\n" {
+		t.Errorf("Log content = %q, want existing content followed by new writes", content)
+	}
+
+	if _, err := logFile.Write([]byte("late\n")); err == nil {
+		t.Error("Expected error writing to a closed log file")
+	}
+}
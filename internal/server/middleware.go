@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -42,8 +48,12 @@ func BaseMiddleware(next HandlerFunc) HandlerFunc {
 			}
 		}
 
-		// Ensure Content-Length is set
-		if _, exists := response.Headers["Content-Length"]; !exists {
+		// Ensure Content-Length is set, except on statuses that never carry a
+		// body and on streams of unknown length, which are sent chunked
+		if bodylessStatus(response.StatusCode) {
+			response.Body = nil
+			delete(response.Headers, "Content-Length")
+		} else if _, exists := response.Headers["Content-Length"]; !exists && response.Reader == nil {
 			response.Headers["Content-Length"] = strconv.Itoa(len(response.Body))
 		}
 
@@ -51,19 +61,110 @@ func BaseMiddleware(next HandlerFunc) HandlerFunc {
 	}
 }
 
+// DefaultMaxLoggedHeaders is how many request headers LoggingMiddleware
+// includes when a request fails
+const DefaultMaxLoggedHeaders = 20
+
+// sensitiveHeaders are masked wherever request headers are logged
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"x-auth-token":        true,
+}
+
 // LoggingMiddleware logs HTTP requests and responses
 func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return LoggingMiddlewareWithConfig(logger, LoggingConfig{})
+}
+
+// LoggingMiddlewareWithMaxHeaders is LoggingMiddleware with failed requests
+// logging at most maxHeaders request headers. Credentials such as
+// Authorization and Cookie are always masked. Zero or less logs none.
+func LoggingMiddlewareWithMaxHeaders(logger *slog.Logger, maxHeaders int) Middleware {
+	if maxHeaders <= 0 {
+		maxHeaders = -1
+	}
+	return LoggingMiddlewareWithConfig(logger, LoggingConfig{MaxHeaders: maxHeaders})
+}
+
+// DefaultLogFields are the attributes LoggingMiddleware logs
+var DefaultLogFields = []string{"method", "path", "remote", "user-agent", "status", "duration", "size", "body_size"}
+
+// LoggingConfig configures LoggingMiddlewareWithConfig. Zero values keep
+// the defaults used by LoggingMiddleware.
+type LoggingConfig struct {
+	// Fields names the attributes to log, e.g. to leave out user-agent or
+	// add host. Each applies to some of the log lines:
+	//
+	//	method, path, query, protocol, host, remote  every line
+	//	user-agent, referer                          the request line
+	//	status, duration, size, body_size            the response line
+	//
+	// Failed requests always log the error, and streamed responses the bytes
+	// sent. Unknown names are ignored. Nil means DefaultLogFields.
+	Fields []string
+
+	// MaxHeaders is how many request headers are logged when a request
+	// fails. Zero means DefaultMaxLoggedHeaders, negative logs none.
+	MaxHeaders int
+}
+
+// requestLogFields are the LoggingConfig.Fields taken from the request, in
+// the order they are logged
+var requestLogFields = []struct {
+	name      string
+	everyLine bool
+	value     func(*Request) string
+}{
+	{"method", true, func(r *Request) string { return r.Method }},
+	{"path", true, func(r *Request) string { return r.Path }},
+	{"query", true, func(r *Request) string { return r.Query }},
+	{"protocol", true, func(r *Request) string { return r.Protocol }},
+	{"host", true, func(r *Request) string { return r.Headers["Host"] }},
+	{"remote", true, func(r *Request) string { return r.RemoteAddr }},
+	{"user-agent", false, func(r *Request) string { return r.Headers["User-Agent"] }},
+	{"referer", false, func(r *Request) string { return r.Headers["Referer"] }},
+}
+
+// LoggingMiddlewareWithConfig logs HTTP requests and responses with the
+// attributes chosen in config
+func LoggingMiddlewareWithConfig(logger *slog.Logger, config LoggingConfig) Middleware {
+	fields := config.Fields
+	if fields == nil {
+		fields = DefaultLogFields
+	}
+	enabled := make(map[string]bool, len(fields))
+	for _, name := range fields {
+		enabled[name] = true
+	}
+	maxHeaders := config.MaxHeaders
+	if maxHeaders == 0 {
+		maxHeaders = DefaultMaxLoggedHeaders
+	} else if maxHeaders < 0 {
+		maxHeaders = 0
+	}
+
+	// requestAttrs returns the enabled request attributes, only those logged
+	// on every line unless all is set
+	requestAttrs := func(request *Request, all bool) []any {
+		var args []any
+		for _, field := range requestLogFields {
+			if enabled[field.name] && (all || field.everyLine) {
+				args = append(args, field.name, field.value(request))
+			}
+		}
+		return args
+	}
+
 	return func(next HandlerFunc) HandlerFunc {
 		return func(request *Request) (*Response, error) {
 			start := time.Now()
 
 			// Log request
-			logger.Info("request",
-				"method", request.Method,
-				"path", request.Path,
-				"remote", request.RemoteAddr,
-				"user-agent", request.Headers["User-Agent"],
-			)
+			logger.Info("request", requestAttrs(request, true)...)
 
 			// Process request
 			response, err := next(request)
@@ -72,23 +173,49 @@ func LoggingMiddleware(logger *slog.Logger) Middleware {
 			duration := time.Since(start)
 
 			// Log response
+			args := requestAttrs(request, false)
 			if err != nil {
-				logger.Error("request failed",
-					"method", request.Method,
-					"path", request.Path,
-					"remote", request.RemoteAddr,
-					"duration", duration,
-					"error", err,
-				)
+				if enabled["duration"] {
+					args = append(args, "duration", duration)
+				}
+				args = append(args, "error", err, loggedHeaders(request.Headers, maxHeaders))
+				logger.Error("request failed", args...)
 			} else if response != nil {
-				logger.Info("response",
-					"method", request.Method,
-					"path", request.Path,
-					"remote", request.RemoteAddr,
-					"status", response.StatusCode,
-					"duration", duration,
-					"size", len(response.Body),
-				)
+				// size is what goes on the wire, body_size is the payload
+				// before any content encoding was applied
+				size := responseSize(response)
+				bodySize := size
+				if response.uncompressedSize > 0 {
+					bodySize = response.uncompressedSize
+				}
+
+				responseArgs := args
+				for _, attr := range []struct {
+					name  string
+					value any
+				}{
+					{"status", response.StatusCode},
+					{"duration", duration},
+					{"size", size},
+					{"body_size", bodySize},
+				} {
+					if enabled[attr.name] {
+						responseArgs = append(responseArgs, attr.name, attr.value)
+					}
+				}
+				logger.Info("response", responseArgs...)
+
+				// Streamed bodies are only written after the pipeline returns,
+				// so record the actual byte count once the reader is closed
+				if response.Reader != nil {
+					streamedArgs := args[:len(args):len(args)]
+					response.Reader = &countingReadCloser{
+						ReadCloser: response.Reader,
+						onClose: func(n int64) {
+							logger.Info("response streamed", append(streamedArgs, "bytes", n)...)
+						},
+					}
+				}
 			}
 
 			return response, err
@@ -96,65 +223,248 @@ func LoggingMiddleware(logger *slog.Logger) Middleware {
 	}
 }
 
-// GzipMiddleware compresses responses with gzip when supported by the client
-func GzipMiddleware(next HandlerFunc) HandlerFunc {
-	return func(request *Request) (*Response, error) {
-		// Check if client accepts gzip encoding
-		acceptEncoding := request.Headers["Accept-Encoding"]
-		if !strings.Contains(acceptEncoding, "gzip") {
-			return next(request)
-		}
+// loggedHeaders returns up to max headers, sorted by name, as a log group
+// with sensitive values masked
+func loggedHeaders(headers map[string]string, max int) slog.Attr {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		// Process request
-		response, err := next(request)
-		if err != nil {
-			return response, err
+	attrs := make([]slog.Attr, 0, min(max, len(names)))
+	for _, name := range names {
+		if len(attrs) >= max {
+			break
+		}
+		value := headers[name]
+		if sensitiveHeaders[strings.ToLower(name)] {
+			value = "[REDACTED]"
 		}
+		attrs = append(attrs, slog.String(name, value))
+	}
 
-		// Don't compress if already compressed
-		if response.Headers["Content-Encoding"] != "" {
-			return response, nil
+	return slog.Attr{Key: "headers", Value: slog.GroupValue(attrs...)}
+}
+
+// responseSize returns the number of body bytes a response will put on the wire
+func responseSize(response *Response) int64 {
+	if response.Reader != nil {
+		if cl, err := strconv.ParseInt(response.Headers["Content-Length"], 10, 64); err == nil {
+			return cl
 		}
+		return 0
+	}
+	return int64(len(response.Body))
+}
 
-		// Don't compress small responses (less than 1KB)
-		if len(response.Body) < 1024 {
-			return response, nil
+// countingReadCloser counts the bytes read through it and reports the total on Close
+type countingReadCloser struct {
+	io.ReadCloser
+	n       int64
+	onClose func(n int64)
+	closed  bool
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if !c.closed {
+		c.closed = true
+		if c.onClose != nil {
+			c.onClose(c.n)
 		}
+	}
+	return err
+}
+
+// DefaultGzipMinSize is the smallest response body GzipMiddleware will compress
+const DefaultGzipMinSize = 1024
+
+// GzipMiddleware compresses responses with gzip when supported by the client.
+// HEAD requests are never compressed: their Content-Length is the size of
+// the file itself, which is what clients probing before a ranged download
+// need, since byte ranges are always served uncompressed.
+func GzipMiddleware(next HandlerFunc) HandlerFunc {
+	return GzipMiddlewareWithMinSize(DefaultGzipMinSize)(next)
+}
+
+// GzipMiddlewareWithMinSize compresses responses of at least minSize bytes
+// with gzip when supported by the client
+func GzipMiddlewareWithMinSize(minSize int) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			// Check if client accepts gzip encoding
+			if !acceptsGzip(request.Headers["Accept-Encoding"]) || request.Method == "HEAD" {
+				return next(request)
+			}
+
+			// Skip paths that name already compressed formats, whatever
+			// Content-Type the response ends up with
+			if compressedExtensions[strings.ToLower(path.Ext(request.Path))] {
+				return next(request)
+			}
+
+			// Process request
+			response, err := next(request)
+			if err != nil {
+				return response, err
+			}
+
+			// Don't compress if already compressed
+			if response.Headers["Content-Encoding"] != "" {
+				return response, nil
+			}
+
+			// Don't compress if a digest of the uncompressed body was sent
+			if response.Headers["Digest"] != "" || response.Headers["Content-MD5"] != "" {
+				return response, nil
+			}
+
+			// Don't compress small responses
+			if len(response.Body) < minSize {
+				return response, nil
+			}
+
+			// Don't compress certain content types
+			contentType := response.Headers["Content-Type"]
+			if shouldNotCompress(contentType) {
+				return response, nil
+			}
+
+			// Compress the response body
+			compressed, err := gzipCompress(response.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			// Keep the original body if compression didn't make it smaller
+			if len(compressed) >= len(response.Body) {
+				return response, nil
+			}
+
+			// Update response
+			response.uncompressedSize = int64(len(response.Body))
+			response.Body = compressed
+			response.Headers["Content-Encoding"] = "gzip"
+			response.Headers["Content-Length"] = strconv.Itoa(len(compressed))
+
+			// Add Vary header to indicate that response varies based on Accept-Encoding
+			if vary := response.Headers["Vary"]; vary != "" {
+				response.Headers["Vary"] = vary + ", Accept-Encoding"
+			} else {
+				response.Headers["Vary"] = "Accept-Encoding"
+			}
 
-		// Don't compress certain content types
-		contentType := response.Headers["Content-Type"]
-		if shouldNotCompress(contentType) {
 			return response, nil
 		}
+	}
+}
 
-		// Compress the response body
-		var buf bytes.Buffer
-		gz := gzip.NewWriter(&buf)
+// gzipWriterPool reuses gzip writers across responses, each one allocates
+// several hundred KB of compression state
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
 
-		// Write compressed data
-		if _, err := gz.Write(response.Body); err != nil {
-			gz.Close()
-			return nil, fmt.Errorf("failed to compress response: %w", err)
-		}
+// gzipCompress returns body compressed with a pooled gzip writer
+func gzipCompress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(&buf)
+
+	// Always detach the writer from buf and return it, even on failure
+	defer func() {
+		gz.Reset(io.Discard)
+		gzipWriterPool.Put(gz)
+	}()
+
+	if _, err := gz.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to compress response: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip, either
+// by name or through "*", honoring q-values: "gzip;q=0" refuses gzip even
+// when "*" is also listed. Members with an unparsable q-value are ignored.
+func acceptsGzip(acceptEncoding string) bool {
+	return encodingQuality(acceptEncoding, "gzip") > 0
+}
 
-		if err := gz.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+// encodingQuality returns the q-value an Accept-Encoding value gives coding,
+// by name or through "*", or 0 if it isn't accepted. "x-gzip" counts as gzip.
+func encodingQuality(acceptEncoding string, coding string) float64 {
+	namedQ, wildcardQ := -1.0, -1.0
+	for _, member := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(member, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "x-gzip" {
+			name = "gzip"
 		}
 
-		// Update response
-		response.Body = buf.Bytes()
-		response.Headers["Content-Encoding"] = "gzip"
-		response.Headers["Content-Length"] = strconv.Itoa(buf.Len())
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					parsed = -1
+				}
+				q = parsed
+			}
+		}
+		if q < 0 {
+			continue
+		}
 
-		// Add Vary header to indicate that response varies based on Accept-Encoding
-		if vary := response.Headers["Vary"]; vary != "" {
-			response.Headers["Vary"] = vary + ", Accept-Encoding"
-		} else {
-			response.Headers["Vary"] = "Accept-Encoding"
+		switch name {
+		case coding:
+			namedQ = q
+		case "*":
+			wildcardQ = q
 		}
+	}
 
-		return response, nil
+	if namedQ >= 0 {
+		return namedQ
 	}
+	return max(wildcardQ, 0)
+}
+
+// compressedExtensions are file extensions of formats that are already
+// compressed, so GzipMiddleware skips requests for them
+var compressedExtensions = map[string]bool{
+	".br":    true,
+	".gz":    true,
+	".tgz":   true,
+	".zip":   true,
+	".7z":    true,
+	".xz":    true,
+	".bz2":   true,
+	".zst":   true,
+	".woff":  true,
+	".woff2": true,
+	".jpg":   true,
+	".jpeg":  true,
+	".png":   true,
+	".gif":   true,
+	".webp":  true,
+	".avif":  true,
+	".mp3":   true,
+	".mp4":   true,
+	".webm":  true,
 }
 
 // shouldNotCompress determines if a content type should not be compressed
@@ -184,26 +494,123 @@ func shouldNotCompress(contentType string) bool {
 	return false
 }
 
+// Default values used by SecurityMiddleware
+const (
+	DefaultFrameOptions   = "DENY"
+	DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+	DefaultCSP            = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline';"
+)
+
+// SecurityConfig configures SecurityMiddlewareWithConfig. Zero values keep
+// the defaults used by SecurityMiddleware.
+type SecurityConfig struct {
+	// FrameOptions is the X-Frame-Options value, e.g. "SAMEORIGIN" or
+	// "ALLOW-FROM https://partner.example". Empty means DefaultFrameOptions.
+	FrameOptions string
+
+	// ReferrerPolicy is the Referrer-Policy value. Empty means DefaultReferrerPolicy.
+	ReferrerPolicy string
+
+	// DisableXSSProtection omits the legacy X-XSS-Protection header
+	DisableXSSProtection bool
+
+	// ContentSecurityPolicy is the policy sent with HTML responses. Empty means DefaultCSP.
+	ContentSecurityPolicy string
+
+	// CSPReportOnly sends the policy as Content-Security-Policy-Report-Only
+	// so violations are reported without being enforced
+	CSPReportOnly bool
+
+	// DisableCSP omits the Content-Security-Policy header entirely
+	DisableCSP bool
+
+	// PermissionsPolicy is the Permissions-Policy value restricting browser
+	// features, e.g. "geolocation=(), microphone=()". Empty omits the header.
+	PermissionsPolicy string
+
+	// ExpectCT is the Expect-CT value, e.g. "max-age=86400, enforce". Browsers
+	// have retired it, so only set it for older clients. Empty omits the header.
+	ExpectCT string
+}
+
 // SecurityMiddleware adds security-related headers
 func SecurityMiddleware(next HandlerFunc) HandlerFunc {
-	return func(request *Request) (*Response, error) {
-		response, err := next(request)
-		if err != nil {
-			return response, err
-		}
+	return SecurityMiddlewareWithConfig(SecurityConfig{})(next)
+}
 
-		// Add security headers
-		response.Headers["X-Content-Type-Options"] = "nosniff"
-		response.Headers["X-Frame-Options"] = "DENY"
-		response.Headers["X-XSS-Protection"] = "1; mode=block"
-		response.Headers["Referrer-Policy"] = "strict-origin-when-cross-origin"
+// SecurityMiddlewareWithConfig adds security-related headers using config
+func SecurityMiddlewareWithConfig(config SecurityConfig) Middleware {
+	frameOptions := config.FrameOptions
+	if frameOptions == "" {
+		frameOptions = DefaultFrameOptions
+	}
+	referrerPolicy := config.ReferrerPolicy
+	if referrerPolicy == "" {
+		referrerPolicy = DefaultReferrerPolicy
+	}
+	csp := config.ContentSecurityPolicy
+	if csp == "" {
+		csp = DefaultCSP
+	}
+	cspHeader := "Content-Security-Policy"
+	if config.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
 
-		// Add CSP for HTML responses
-		if strings.Contains(response.Headers["Content-Type"], "text/html") {
-			response.Headers["Content-Security-Policy"] = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline';"
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			response, err := next(request)
+			if err != nil {
+				return response, err
+			}
+
+			// Add security headers
+			response.Headers["X-Content-Type-Options"] = "nosniff"
+			response.Headers["X-Frame-Options"] = frameOptions
+			response.Headers["Referrer-Policy"] = referrerPolicy
+			if !config.DisableXSSProtection {
+				response.Headers["X-XSS-Protection"] = "1; mode=block"
+			}
+
+			if config.PermissionsPolicy != "" {
+				response.Headers["Permissions-Policy"] = config.PermissionsPolicy
+			}
+			if config.ExpectCT != "" {
+				response.Headers["Expect-CT"] = config.ExpectCT
+			}
+
+			// Add CSP for HTML responses
+			if !config.DisableCSP && strings.Contains(response.Headers["Content-Type"], "text/html") {
+				response.Headers[cspHeader] = csp
+			}
+
+			return response, nil
 		}
+	}
+}
 
-		return response, nil
+// HSTSMiddleware adds a Strict-Transport-Security header to every response.
+// The header only takes effect over TLS, so enable it for HTTPS deployments.
+func HSTSMiddleware(maxAge time.Duration, includeSubdomains, preload bool) Middleware {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			response, err := next(request)
+			if err != nil {
+				return response, err
+			}
+
+			response.Headers["Strict-Transport-Security"] = value
+
+			return response, nil
+		}
 	}
 }
 
@@ -211,30 +618,175 @@ func SecurityMiddleware(next HandlerFunc) HandlerFunc {
 func CORSMiddleware(allowedOrigins []string) Middleware {
 	return func(next HandlerFunc) HandlerFunc {
 		return func(request *Request) (*Response, error) {
-			origin := request.Headers["Origin"]
-
-			// Check if origin is allowed
-			allowed := false
-			for _, allowedOrigin := range allowedOrigins {
-				if allowedOrigin == "*" || allowedOrigin == origin {
-					allowed = true
-					break
+			return serveCORS(request, next, allowedOrigins)
+		}
+	}
+}
+
+// serveCORS runs next and adds the CORS headers when the request's origin
+// is in allowedOrigins
+func serveCORS(request *Request, next HandlerFunc, allowedOrigins []string) (*Response, error) {
+	origin := request.Headers["Origin"]
+
+	// Check if origin is allowed
+	allowed := false
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin == "*" || allowedOrigin == origin {
+			allowed = true
+			break
+		}
+	}
+
+	response, err := next(request)
+	if err != nil {
+		return response, err
+	}
+
+	if allowed && origin != "" {
+		response.Headers["Access-Control-Allow-Origin"] = origin
+		response.Headers["Access-Control-Allow-Methods"] = "GET, HEAD, OPTIONS"
+		response.Headers["Access-Control-Allow-Headers"] = "Content-Type, Accept"
+		response.Headers["Access-Control-Max-Age"] = "86400"
+	}
+
+	return response, nil
+}
+
+// RewriteMiddleware internally rewrites request paths matching pattern to
+// replacement, which may refer to capture groups as in regexp.Expand, e.g.
+// "/new/$1" for "^/old/(.*)$". Clients aren't redirected; the handler and
+// inner middlewares see the new Path while RawPath keeps the original target.
+// In HTTPServer.Middlewares it runs after routing, which suits handlers that
+// serve by path such as the default file handler; in PreRoutingMiddlewares
+// the new path is also used to pick the handler.
+func RewriteMiddleware(pattern *regexp.Regexp, replacement string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			if pattern.MatchString(request.Path) {
+				request.Path = pattern.ReplaceAllString(request.Path, replacement)
+			}
+			return next(request)
+		}
+	}
+}
+
+// DefaultOverrideMethods are the methods MethodOverrideMiddleware accepts
+// when none are given
+var DefaultOverrideMethods = []string{"PUT", "PATCH", "DELETE"}
+
+// MethodOverrideMiddleware lets POST requests stand in for other methods,
+// named in an X-HTTP-Method-Override header, for clients such as HTML forms
+// that can only send GET and POST. Only the allowed methods are honored,
+// DefaultOverrideMethods when none are given; other values are ignored.
+// Add it to HTTPServer.PreRoutingMiddlewares so routing sees the new method.
+func MethodOverrideMiddleware(allowed ...string) Middleware {
+	if len(allowed) == 0 {
+		allowed = DefaultOverrideMethods
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			// TextprotoHeaders stores the name in its canonical form
+			override := request.Headers["X-HTTP-Method-Override"]
+			if override == "" {
+				override = request.Headers["X-Http-Method-Override"]
+			}
+			override = strings.ToUpper(strings.TrimSpace(override))
+			if request.Method == "POST" && override != "" {
+				for _, method := range allowed {
+					if strings.EqualFold(method, override) {
+						request.Method = override
+						break
+					}
 				}
 			}
+			return next(request)
+		}
+	}
+}
 
-			response, err := next(request)
-			if err != nil {
-				return response, err
+// ContentTypeMiddleware rejects POST, PUT and PATCH requests with a body
+// whose Content-Type isn't one of allowed with 415 Unsupported Media Type.
+// Entries are media types such as "application/json", or "text/*" for any
+// subtype; parameters like charset are ignored. Requests without a body pass.
+func ContentTypeMiddleware(allowed ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			switch request.Method {
+			case "POST", "PUT", "PATCH":
+				if len(request.Body) > 0 && !contentTypeAllowed(request.Headers["Content-Type"], allowed) {
+					return HTTP415UnsupportedMediaType(), nil
+				}
+			}
+			return next(request)
+		}
+	}
+}
+
+// contentTypeAllowed reports whether a Content-Type value matches an allowlist entry
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if entry == mediaType || entry == mainType+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HostCheckMiddleware rejects requests whose Host header isn't in allowedHosts,
+// guarding against DNS rebinding and Host header attacks. Entries are exact
+// host names or "*.example.com" for any subdomain; ports are ignored. Unknown
+// hosts get 421 Misdirected Request, HTTP/1.1 requests without Host a 400.
+// Add it to HTTPServer.PreRoutingMiddlewares so requests for paths that
+// don't exist get a 421 too, rather than revealing a 404.
+func HostCheckMiddleware(allowedHosts []string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			host, present := request.Headers["Host"]
+			if !present {
+				// HTTP/1.0 clients may omit Host, there is nothing to check
+				if request.Protocol == "HTTP/1.1" {
+					return HTTP400BadRequest(), nil
+				}
+				return next(request)
 			}
 
-			if allowed && origin != "" {
-				response.Headers["Access-Control-Allow-Origin"] = origin
-				response.Headers["Access-Control-Allow-Methods"] = "GET, HEAD, OPTIONS"
-				response.Headers["Access-Control-Allow-Headers"] = "Content-Type, Accept"
-				response.Headers["Access-Control-Max-Age"] = "86400"
+			if !hostAllowed(host, allowedHosts) {
+				return HTTP421MisdirectedRequest(), nil
 			}
 
-			return response, nil
+			return next(request)
 		}
 	}
 }
+
+// hostAllowed reports whether a Host header value matches an allowlist entry
+func hostAllowed(host string, allowedHosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
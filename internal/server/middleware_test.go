@@ -3,10 +3,18 @@ package server
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -89,6 +97,266 @@ func TestSecurityMiddlewareNonHTML(t *testing.T) {
 	}
 }
 
+func TestSecurityMiddlewareWithConfig(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers: map[string]string{
+				"Content-Type": "text/html; charset=utf-8",
+			},
+			Body: []byte("<html><body>Widget</body></html>"),
+		}, nil
+	}
+
+	tests := []struct {
+		name             string
+		config           SecurityConfig
+		expectedFrame    string
+		expectedReferrer string
+		expectXSS        bool
+	}{
+		{
+			name:             "zero config keeps defaults",
+			config:           SecurityConfig{},
+			expectedFrame:    "DENY",
+			expectedReferrer: "strict-origin-when-cross-origin",
+			expectXSS:        true,
+		},
+		{
+			name:             "same origin framing",
+			config:           SecurityConfig{FrameOptions: "SAMEORIGIN"},
+			expectedFrame:    "SAMEORIGIN",
+			expectedReferrer: "strict-origin-when-cross-origin",
+			expectXSS:        true,
+		},
+		{
+			name:             "allow from partner",
+			config:           SecurityConfig{FrameOptions: "ALLOW-FROM https://partner.example"},
+			expectedFrame:    "ALLOW-FROM https://partner.example",
+			expectedReferrer: "strict-origin-when-cross-origin",
+			expectXSS:        true,
+		},
+		{
+			name:             "custom referrer policy",
+			config:           SecurityConfig{ReferrerPolicy: "no-referrer"},
+			expectedFrame:    "DENY",
+			expectedReferrer: "no-referrer",
+			expectXSS:        true,
+		},
+		{
+			name:             "legacy XSS header disabled",
+			config:           SecurityConfig{DisableXSSProtection: true},
+			expectedFrame:    "DENY",
+			expectedReferrer: "strict-origin-when-cross-origin",
+			expectXSS:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := SecurityMiddlewareWithConfig(tt.config)(handler)
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/widget",
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.Headers["X-Frame-Options"] != tt.expectedFrame {
+				t.Errorf("X-Frame-Options = %q, want %q", resp.Headers["X-Frame-Options"], tt.expectedFrame)
+			}
+			if resp.Headers["Referrer-Policy"] != tt.expectedReferrer {
+				t.Errorf("Referrer-Policy = %q, want %q", resp.Headers["Referrer-Policy"], tt.expectedReferrer)
+			}
+			if _, exists := resp.Headers["X-XSS-Protection"]; exists != tt.expectXSS {
+				t.Errorf("X-XSS-Protection present = %v, want %v", exists, tt.expectXSS)
+			}
+			if resp.Headers["X-Content-Type-Options"] != "nosniff" {
+				t.Error("Expected nosniff regardless of config")
+			}
+		})
+	}
+}
+
+func TestSecurityMiddlewareCSPConfig(t *testing.T) {
+	strictCSP := "default-src 'self'; script-src 'self'; object-src 'none'"
+
+	tests := []struct {
+		name           string
+		config         SecurityConfig
+		contentType    string
+		expectedHeader string
+		expectedValue  string
+	}{
+		{
+			name:           "default policy",
+			config:         SecurityConfig{},
+			contentType:    "text/html; charset=utf-8",
+			expectedHeader: "Content-Security-Policy",
+			expectedValue:  DefaultCSP,
+		},
+		{
+			name:           "custom policy",
+			config:         SecurityConfig{ContentSecurityPolicy: strictCSP},
+			contentType:    "text/html; charset=utf-8",
+			expectedHeader: "Content-Security-Policy",
+			expectedValue:  strictCSP,
+		},
+		{
+			name:           "report only",
+			config:         SecurityConfig{ContentSecurityPolicy: strictCSP, CSPReportOnly: true},
+			contentType:    "text/html; charset=utf-8",
+			expectedHeader: "Content-Security-Policy-Report-Only",
+			expectedValue:  strictCSP,
+		},
+		{
+			name:        "disabled",
+			config:      SecurityConfig{DisableCSP: true},
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:        "custom policy not applied to non-HTML",
+			config:      SecurityConfig{ContentSecurityPolicy: strictCSP},
+			contentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(req *Request) (*Response, error) {
+				return &Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Headers: map[string]string{
+						"Content-Type": tt.contentType,
+					},
+					Body: []byte("body"),
+				}, nil
+			}
+
+			wrapped := SecurityMiddlewareWithConfig(tt.config)(handler)
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/",
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for _, header := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+				value, exists := resp.Headers[header]
+				if header == tt.expectedHeader {
+					if value != tt.expectedValue {
+						t.Errorf("%s = %q, want %q", header, value, tt.expectedValue)
+					}
+				} else if exists {
+					t.Errorf("Did not expect %s header, got %q", header, value)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityMiddlewareOptionalHeaders(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte("body"),
+		}, nil
+	}
+
+	tests := []struct {
+		name              string
+		config            SecurityConfig
+		permissionsPolicy string
+		expectCT          string
+	}{
+		{"off by default", SecurityConfig{}, "", ""},
+		{"permissions policy", SecurityConfig{PermissionsPolicy: "geolocation=(), microphone=()"}, "geolocation=(), microphone=()", ""},
+		{"expect-ct", SecurityConfig{ExpectCT: "max-age=86400, enforce"}, "", "max-age=86400, enforce"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: "GET", Path: "/", Protocol: "HTTP/1.1", Headers: make(map[string]string)}
+			resp, err := SecurityMiddlewareWithConfig(tt.config)(handler)(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for header, want := range map[string]string{"Permissions-Policy": tt.permissionsPolicy, "Expect-CT": tt.expectCT} {
+				value, exists := resp.Headers[header]
+				if want == "" && exists {
+					t.Errorf("Did not expect %s header, got %q", header, value)
+				} else if value != want {
+					t.Errorf("%s = %q, want %q", header, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHSTSMiddleware(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers:    make(map[string]string),
+			Body:       []byte("test"),
+		}, nil
+	}
+
+	tests := []struct {
+		name              string
+		maxAge            time.Duration
+		includeSubdomains bool
+		preload           bool
+		expected          string
+	}{
+		{"max-age only", 365 * 24 * time.Hour, false, false, "max-age=31536000"},
+		{"include subdomains", time.Hour, true, false, "max-age=3600; includeSubDomains"},
+		{"preload", time.Hour, false, true, "max-age=3600; preload"},
+		{"all directives", 2 * 365 * 24 * time.Hour, true, true, "max-age=63072000; includeSubDomains; preload"},
+		{"zero max-age", 0, false, false, "max-age=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := HSTSMiddleware(tt.maxAge, tt.includeSubdomains, tt.preload)(handler)
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.Headers["Strict-Transport-Security"] != tt.expected {
+				t.Errorf("Strict-Transport-Security = %q, want %q", resp.Headers["Strict-Transport-Security"], tt.expected)
+			}
+		})
+	}
+}
+
 func TestCORSMiddleware(t *testing.T) {
 	handler := func(req *Request) (*Response, error) {
 		return &Response{
@@ -299,36 +567,316 @@ func TestGzipMiddlewareNoCompression(t *testing.T) {
 				}, nil
 			}
 
-			wrapped := GzipMiddleware(handler)
+			wrapped := GzipMiddleware(handler)
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Accept-Encoding": tt.acceptHeader,
+				},
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if tt.shouldCompress {
+				if resp.Headers["Content-Encoding"] != "gzip" {
+					t.Error("Expected Content-Encoding: gzip")
+				}
+			} else {
+				if resp.Headers["Content-Encoding"] == "gzip" {
+					t.Error("Should not have compressed response")
+				}
+				// Body should be unchanged
+				if !bytes.Equal(resp.Body, body) {
+					t.Error("Body was modified when it shouldn't have been")
+				}
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareAcceptEncodingWildcard(t *testing.T) {
+	body := []byte(strings.Repeat("compress me ", 200))
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       body,
+		}, nil
+	}
+	wrapped := GzipMiddleware(handler)
+
+	tests := []struct {
+		acceptEncoding string
+		shouldCompress bool
+	}{
+		{"*", true},
+		{"gzip;q=0, *", false},
+		{"*;q=0", false},
+		{"br, *;q=0.5", true},
+		{"gzip;q=0.8, *;q=0", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0", false},
+		{"identity", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers:  map[string]string{"Accept-Encoding": tt.acceptEncoding},
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if compressed := resp.Headers["Content-Encoding"] == "gzip"; compressed != tt.shouldCompress {
+				t.Errorf("Compressed = %v, want %v", compressed, tt.shouldCompress)
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareIncompressible(t *testing.T) {
+	// Random data doesn't compress, gzip framing makes it larger
+	body := make([]byte, 2048)
+	if _, err := rand.Read(body); err != nil {
+		t.Fatalf("Failed to generate random data: %v", err)
+	}
+
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers: map[string]string{
+				"Content-Type":   "text/plain",
+				"Content-Length": fmt.Sprintf("%d", len(body)),
+			},
+			Body: body,
+		}, nil
+	}
+
+	wrapped := GzipMiddleware(handler)
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/random.txt",
+		Protocol: "HTTP/1.1",
+		Headers: map[string]string{
+			"Accept-Encoding": "gzip",
+		},
+	}
+
+	resp, err := wrapped(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, exists := resp.Headers["Content-Encoding"]; exists {
+		t.Errorf("Content-Encoding = %q, want none", resp.Headers["Content-Encoding"])
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Error("Expected original body to be returned")
+	}
+	if resp.Headers["Content-Length"] != fmt.Sprintf("%d", len(body)) {
+		t.Errorf("Content-Length = %v, want %d", resp.Headers["Content-Length"], len(body))
+	}
+}
+
+// TestGzipMiddlewareCompressedExtensions tests that requests for compressed
+// formats are skipped by path, even when mislabeled as text
+func TestGzipMiddlewareCompressedExtensions(t *testing.T) {
+	body := bytes.Repeat([]byte("not really a font "), 200)
+
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			Body: body,
+		}, nil
+	}
+
+	tests := []struct {
+		path       string
+		compressed bool
+	}{
+		{"/fonts/site.woff2", false},
+		{"/fonts/SITE.WOFF2", false},
+		{"/bundle.js.br", false},
+		{"/archive.tar.gz", false},
+		{"/notes.txt", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     tt.path,
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Accept-Encoding": "gzip",
+				},
+			}
+
+			resp, err := GzipMiddleware(handler)(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if compressed := resp.Headers["Content-Encoding"] == "gzip"; compressed != tt.compressed {
+				t.Errorf("compressed = %v, want %v", compressed, tt.compressed)
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareWithMinSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		bodySize       int
+		shouldCompress bool
+	}{
+		{"above threshold", 300, true},
+		{"below threshold", 100, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("a"), tt.bodySize)
+
+			handler := func(req *Request) (*Response, error) {
+				return &Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Headers: map[string]string{
+						"Content-Type": "text/plain",
+					},
+					Body: body,
+				}, nil
+			}
+
+			wrapped := GzipMiddlewareWithMinSize(256)(handler)
+
+			req := &Request{
+				Method:   "GET",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Accept-Encoding": "gzip",
+				},
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			compressed := resp.Headers["Content-Encoding"] == "gzip"
+			if compressed != tt.shouldCompress {
+				t.Errorf("compressed = %v, want %v", compressed, tt.shouldCompress)
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareSkipsDigestedResponses(t *testing.T) {
+	body := bytes.Repeat([]byte("digest "), 500)
+
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+				"Digest":       "sha-256=placeholder",
+			},
+			Body: body,
+		}, nil
+	}
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/test",
+		Protocol: "HTTP/1.1",
+		Headers: map[string]string{
+			"Accept-Encoding": "gzip",
+		},
+	}
+
+	resp, err := GzipMiddleware(handler)(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-			req := &Request{
+	// Compressing would make the digest of the original body wrong
+	if resp.Headers["Content-Encoding"] == "gzip" {
+		t.Error("Should not compress a response carrying a Digest header")
+	}
+	if !bytes.Equal(resp.Body, body) {
+		t.Error("Body was modified when it shouldn't have been")
+	}
+}
+
+func TestGzipMiddlewareConcurrent(t *testing.T) {
+	wrapped := GzipMiddleware(func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte(strings.Repeat(req.Path+" ", 500)),
+		}, nil
+	})
+
+	// Pooled writers must never leak one response's data into another
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("/client-%d", id)
+			resp, err := wrapped(&Request{
 				Method:   "GET",
-				Path:     "/test",
+				Path:     path,
 				Protocol: "HTTP/1.1",
-				Headers: map[string]string{
-					"Accept-Encoding": tt.acceptHeader,
-				},
+				Headers:  map[string]string{"Accept-Encoding": "gzip"},
+			})
+			if err != nil {
+				errs <- err
+				return
 			}
 
-			resp, err := wrapped(req)
+			gz, err := gzip.NewReader(bytes.NewReader(resp.Body))
 			if err != nil {
-				t.Fatalf("Unexpected error: %v", err)
+				errs <- fmt.Errorf("client %d: %v", id, err)
+				return
 			}
-
-			if tt.shouldCompress {
-				if resp.Headers["Content-Encoding"] != "gzip" {
-					t.Error("Expected Content-Encoding: gzip")
-				}
-			} else {
-				if resp.Headers["Content-Encoding"] == "gzip" {
-					t.Error("Should not have compressed response")
-				}
-				// Body should be unchanged
-				if !bytes.Equal(resp.Body, body) {
-					t.Error("Body was modified when it shouldn't have been")
-				}
+			decompressed, err := io.ReadAll(gz)
+			if err != nil {
+				errs <- fmt.Errorf("client %d: %v", id, err)
+				return
 			}
-		})
+			if string(decompressed) != strings.Repeat(path+" ", 500) {
+				errs <- fmt.Errorf("client %d got another response's body", id)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
 	}
 }
 
@@ -367,6 +915,190 @@ func TestGzipMiddlewareExistingVaryHeader(t *testing.T) {
 	}
 }
 
+func TestBaseMiddlewareBodylessStatuses(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		headers    map[string]string
+	}{
+		{"204 No Content", 204, map[string]string{}},
+		{"304 Not Modified", 304, map[string]string{"ETag": `"abc"`, "Content-Length": "42"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(req *Request) (*Response, error) {
+				return &Response{
+					StatusCode: tt.statusCode,
+					Headers:    tt.headers,
+					Body:       []byte("should not be sent"),
+				}, nil
+			}
+
+			resp, err := BaseMiddleware(handler)(&Request{Method: "GET", Path: "/", Protocol: "HTTP/1.1"})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if resp.Body != nil {
+				t.Errorf("Expected no body, got %q", resp.Body)
+			}
+			if cl, exists := resp.Headers["Content-Length"]; exists {
+				t.Errorf("Expected no Content-Length, got %q", cl)
+			}
+			if tt.statusCode == 304 && resp.Headers["ETag"] != `"abc"` {
+				t.Error("304 response lost its cache headers")
+			}
+		})
+	}
+}
+
+func TestHostCheckMiddleware(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return &Response{StatusCode: 200, Headers: make(map[string]string)}, nil
+	}
+	wrapped := HostCheckMiddleware([]string{"example.com", "*.example.org"})(handler)
+
+	tests := []struct {
+		name           string
+		protocol       string
+		host           string
+		omitHost       bool
+		expectedStatus int
+	}{
+		{"allowed host", "HTTP/1.1", "example.com", false, 200},
+		{"allowed host with port", "HTTP/1.1", "Example.COM:8080", false, 200},
+		{"wildcard subdomain", "HTTP/1.1", "api.example.org", false, 200},
+		{"wildcard excludes apex", "HTTP/1.1", "example.org", false, 421},
+		{"disallowed host", "HTTP/1.1", "evil.test", false, 421},
+		{"suffix trick", "HTTP/1.1", "notexample.com", false, 421},
+		{"missing host on HTTP/1.1", "HTTP/1.1", "", true, 400},
+		{"missing host on HTTP/1.0", "HTTP/1.0", "", true, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: "GET", Path: "/", Protocol: tt.protocol, Headers: map[string]string{}}
+			if !tt.omitHost {
+				req.Headers["Host"] = tt.host
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestContentTypeMiddleware(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return &Response{StatusCode: 200, Headers: make(map[string]string)}, nil
+	}
+	wrapped := ContentTypeMiddleware("application/json", "text/*")(handler)
+
+	tests := []struct {
+		name           string
+		method         string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"allowed type", "POST", "application/json", `{"a":1}`, 200},
+		{"allowed type with charset", "PUT", "Application/JSON; charset=utf-8", `{"a":1}`, 200},
+		{"allowed subtype wildcard", "PATCH", "text/csv", "a,b", 200},
+		{"disallowed type", "POST", "application/xml", "<a/>", 415},
+		{"missing type", "POST", "", `{"a":1}`, 415},
+		{"no body", "POST", "", "", 200},
+		{"method without body", "GET", "application/xml", "", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Method: tt.method, Path: "/api", Protocol: "HTTP/1.1", Headers: map[string]string{}, Body: []byte(tt.body)}
+			if tt.contentType != "" {
+				req.Headers["Content-Type"] = tt.contentType
+			}
+
+			resp, err := wrapped(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("StatusCode = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestRewriteMiddleware(t *testing.T) {
+	var seen string
+	handler := func(req *Request) (*Response, error) {
+		seen = req.Path
+		return &Response{StatusCode: 200, Headers: make(map[string]string)}, nil
+	}
+	wrapped := RewriteMiddleware(regexp.MustCompile(`^/old/(.*)$`), "/new/$1")(handler)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/old/docs/page.html", "/new/docs/page.html"},
+		{"/old/", "/new/"},
+		{"/other/old/page.html", "/other/old/page.html"},
+		{"/index.html", "/index.html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := &Request{Method: "GET", Path: tt.path, RawPath: tt.path, Headers: map[string]string{}}
+			if _, err := wrapped(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if seen != tt.expected {
+				t.Errorf("Handler saw path %q, want %q", seen, tt.expected)
+			}
+			if req.RawPath != tt.path {
+				t.Errorf("RawPath = %q, want the original %q", req.RawPath, tt.path)
+			}
+		})
+	}
+}
+
+// TestRewriteMiddlewareServesFile tests an internal rewrite through the server's file handler
+func TestRewriteMiddlewareServesFile(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "new"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "new", "page.html"), []byte("new page"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Middlewares = append(server.Middlewares, RewriteMiddleware(regexp.MustCompile(`^/old/(.*)$`), "/new/$1"))
+
+	resp := server.handleRequest(&Request{Method: "GET", Path: "/old/page.html", Protocol: "HTTP/1.1", Headers: map[string]string{}})
+	if resp.StatusCode != 200 {
+		t.Fatalf("StatusCode = %d, want 200", resp.StatusCode)
+	}
+	if _, hasLocation := resp.Headers["Location"]; hasLocation {
+		t.Error("Expected an internal rewrite, not a redirect")
+	}
+
+	body := resp.Body
+	if resp.Reader != nil {
+		body, _ = io.ReadAll(resp.Reader)
+		resp.Reader.Close()
+	}
+	if string(body) != "new page" {
+		t.Errorf("Body = %q, want %q", body, "new page")
+	}
+}
+
 func TestLoggingMiddlewareSuccess(t *testing.T) {
 	// Create a buffer to capture log output
 	var buf bytes.Buffer
@@ -485,6 +1217,209 @@ func TestLoggingMiddlewareError(t *testing.T) {
 	}
 }
 
+func TestLoggingMiddlewareRedactsHeaders(t *testing.T) {
+	handler := func(req *Request) (*Response, error) {
+		return nil, io.EOF
+	}
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/private",
+		Protocol: "HTTP/1.1",
+		Headers: map[string]string{
+			"Authorization": "Bearer secret-token",
+			"Cookie":        "session=secret-session",
+			"Host":          "example.com",
+			"User-Agent":    "TestAgent/1.0",
+		},
+	}
+
+	t.Run("redacts credentials", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+		LoggingMiddleware(logger)(handler)(req)
+
+		logOutput := buf.String()
+		if !strings.Contains(logOutput, "headers.User-Agent=TestAgent/1.0") {
+			t.Errorf("Expected User-Agent in error log, got: %s", logOutput)
+		}
+		if !strings.Contains(logOutput, "headers.Authorization=[REDACTED]") {
+			t.Errorf("Expected Authorization to be redacted, got: %s", logOutput)
+		}
+		if strings.Contains(logOutput, "secret") {
+			t.Errorf("Secret leaked into log: %s", logOutput)
+		}
+	})
+
+	t.Run("max headers", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+		LoggingMiddlewareWithMaxHeaders(logger, 1)(handler)(req)
+
+		logOutput := buf.String()
+		if got := strings.Count(logOutput, "headers."); got != 1 {
+			t.Errorf("Expected 1 logged header, got %d: %s", got, logOutput)
+		}
+	})
+}
+
+func TestLoggingMiddlewareFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	handler := func(req *Request) (*Response, error) {
+		return HTTPBaseResponse(200, "OK"), nil
+	}
+	req := &Request{
+		Method:     "GET",
+		Path:       "/page",
+		Protocol:   "HTTP/1.1",
+		RemoteAddr: "10.0.0.1:54321",
+		Headers: map[string]string{
+			"Host":       "example.com",
+			"User-Agent": "TestAgent/1.0",
+		},
+	}
+
+	config := LoggingConfig{Fields: []string{"method", "host", "status", "no-such-field"}}
+	LoggingMiddlewareWithConfig(logger, config)(handler)(req)
+
+	expected := map[string][]string{
+		"request":  {"method", "host"},
+		"response": {"method", "host", "status"},
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d log lines, got %d: %s", len(expected), len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to parse log line %q: %v", line, err)
+		}
+		msg, _ := entry["msg"].(string)
+		want, ok := expected[msg]
+		if !ok {
+			t.Errorf("Unexpected log line %q", line)
+			continue
+		}
+
+		var got []string
+		for key := range entry {
+			if key != "time" && key != "level" && key != "msg" {
+				got = append(got, key)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s line logged %v, want only %v", msg, got, want)
+		}
+	}
+	if entry := buf.String(); strings.Contains(entry, "TestAgent") || strings.Contains(entry, "10.0.0.1") {
+		t.Errorf("Fields left out of the config were logged: %s", entry)
+	}
+}
+
+func TestLoggingMiddlewareGzipSizes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	body := bytes.Repeat([]byte("compress me "), 200)
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       body,
+		}, nil
+	}
+
+	// Same order as the default server pipeline: logging wraps gzip
+	wrapped := LoggingMiddleware(logger)(GzipMiddleware(handler))
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/gzip",
+		Protocol: "HTTP/1.1",
+		Headers:  map[string]string{"Accept-Encoding": "gzip"},
+	}
+
+	resp, err := wrapped(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if resp.Headers["Content-Encoding"] != "gzip" {
+		t.Fatal("Expected response to be gzipped")
+	}
+
+	logOutput := buf.String()
+	if !strings.Contains(logOutput, fmt.Sprintf("size=%d ", len(resp.Body))) {
+		t.Errorf("Expected compressed size %d in log, got: %s", len(resp.Body), logOutput)
+	}
+	if !strings.Contains(logOutput, fmt.Sprintf("body_size=%d", len(body))) {
+		t.Errorf("Expected uncompressed size %d in log, got: %s", len(body), logOutput)
+	}
+}
+
+func TestLoggingMiddlewareStreamedSizes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	content := strings.Repeat("x", 4096)
+	handler := func(req *Request) (*Response, error) {
+		return &Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Headers: map[string]string{
+				"Content-Length": fmt.Sprintf("%d", len(content)),
+			},
+			Reader: io.NopCloser(strings.NewReader(content)),
+		}, nil
+	}
+
+	wrapped := LoggingMiddleware(logger)(handler)
+
+	req := &Request{
+		Method:   "GET",
+		Path:     "/stream",
+		Protocol: "HTTP/1.1",
+		Headers:  make(map[string]string),
+	}
+
+	resp, err := wrapped(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	logOutput := buf.String()
+	if !strings.Contains(logOutput, "size=4096 body_size=4096") {
+		t.Errorf("Expected streamed size in response log, got: %s", logOutput)
+	}
+
+	// Simulate writeResponse streaming and closing the body
+	n, err := io.Copy(io.Discard, resp.Reader)
+	if err != nil {
+		t.Fatalf("Failed to read streamed body: %v", err)
+	}
+	resp.Reader.Close()
+
+	if n != int64(len(content)) {
+		t.Errorf("Streamed %d bytes, want %d", n, len(content))
+	}
+
+	logOutput = buf.String()
+	if !strings.Contains(logOutput, "response streamed") {
+		t.Error("Expected 'response streamed' log entry")
+	}
+	if !strings.Contains(logOutput, "bytes=4096") {
+		t.Errorf("Expected streamed byte count in log, got: %s", logOutput)
+	}
+}
+
 func TestBaseMiddlewareDefaults(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -715,3 +1650,41 @@ func TestShouldNotCompress(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkGzipMiddleware(b *testing.B) {
+	body := bytes.Repeat([]byte("benchmark response body "), 400)
+	req := &Request{
+		Method:   "GET",
+		Path:     "/bench",
+		Protocol: "HTTP/1.1",
+		Headers:  map[string]string{"Accept-Encoding": "gzip"},
+	}
+
+	// Pooled is GzipMiddleware, unpooled allocates a writer per response as it used to
+	b.Run("pooled", func(b *testing.B) {
+		wrapped := GzipMiddleware(func(req *Request) (*Response, error) {
+			return &Response{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": "text/plain"},
+				Body:       body,
+			}, nil
+		})
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := wrapped(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RulesFileName is the file in the document root that LoadRules reads
+const RulesFileName = "_rules"
+
+// Rules holds the redirects and header rules declared in a rules file. Each
+// non-blank line that doesn't start with '#' is one rule:
+//
+//	redirect /old-page /new-page 301
+//	redirect /blog/* /posts/:splat
+//	header /assets/* Cache-Control: public, max-age=31536000
+//	cors https://app.example https://admin.example
+//	cache-max-age 24h
+//
+// Paths are exact, or prefixes when they end in "*". A redirect's status
+// defaults to 301 and ":splat" in its target is replaced with the part of the
+// path matched by "*". The cors and cache-max-age settings are the ones
+// ReloadConfig carries, so they can be re-read while serving.
+type Rules struct {
+	Redirects []RedirectRule
+	Headers   []HeaderRule
+
+	CORSOrigins []string      // Origins allowed by HTTPServer.CORSMiddleware
+	CacheMaxAge time.Duration // How long clients may cache static assets, zero for the default
+}
+
+// RedirectRule redirects requests for From to To
+type RedirectRule struct {
+	From   string
+	To     string
+	Status int
+}
+
+// HeaderRule adds a response header to requests for Path
+type HeaderRule struct {
+	Path  string
+	Name  string
+	Value string
+}
+
+// LoadRules reads RulesFileName from dir. A missing file yields no rules.
+func LoadRules(dir string) (*Rules, error) {
+	path := filepath.Join(dir, RulesFileName)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Rules{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer file.Close()
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// ParseRules parses a rules file, failing on the first malformed line
+func ParseRules(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	scanner := bufio.NewScanner(r)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, rest, _ := strings.Cut(line, " ")
+		var err error
+		switch kind {
+		case "redirect":
+			err = rules.parseRedirect(strings.Fields(rest))
+		case "header":
+			err = rules.parseHeader(strings.TrimSpace(rest))
+		case "cors":
+			origins := strings.Fields(rest)
+			if len(origins) == 0 {
+				err = errors.New("cors needs at least one origin")
+			}
+			rules.CORSOrigins = append(rules.CORSOrigins, origins...)
+		case "cache-max-age":
+			rules.CacheMaxAge, err = time.ParseDuration(strings.TrimSpace(rest))
+			if err != nil || rules.CacheMaxAge < 0 {
+				err = fmt.Errorf("invalid cache-max-age %q", strings.TrimSpace(rest))
+			}
+		default:
+			err = fmt.Errorf("unknown rule %q", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// parseRedirect parses the fields after "redirect": from, to and an optional status
+func (rules *Rules) parseRedirect(fields []string) error {
+	if len(fields) != 2 && len(fields) != 3 {
+		return errors.New("redirect needs a source, a target and an optional status")
+	}
+	if err := validateRulePath(fields[0]); err != nil {
+		return err
+	}
+
+	status := http.StatusMovedPermanently
+	if len(fields) == 3 {
+		code, err := strconv.Atoi(fields[2])
+		if err != nil || code < 300 || code > 399 || http.StatusText(code) == "" {
+			return fmt.Errorf("invalid redirect status %q", fields[2])
+		}
+		status = code
+	}
+
+	rules.Redirects = append(rules.Redirects, RedirectRule{From: fields[0], To: fields[1], Status: status})
+	return nil
+}
+
+// parseHeader parses the text after "header": a path and a "Name: value" pair
+func (rules *Rules) parseHeader(rest string) error {
+	path, field, found := strings.Cut(rest, " ")
+	if !found {
+		return errors.New("header needs a path and a \"Name: value\" field")
+	}
+	if err := validateRulePath(path); err != nil {
+		return err
+	}
+
+	name, value, found := strings.Cut(field, ":")
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if !found || !isToken(name) || value == "" {
+		return fmt.Errorf("invalid header field %q", strings.TrimSpace(field))
+	}
+
+	rules.Headers = append(rules.Headers, HeaderRule{Path: path, Name: name, Value: value})
+	return nil
+}
+
+// validateRulePath checks that path is absolute with at most a trailing wildcard
+func validateRulePath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q must start with /", path)
+	}
+	if strings.Contains(strings.TrimSuffix(path, "*"), "*") {
+		return fmt.Errorf("path %q may only end in a wildcard", path)
+	}
+	return nil
+}
+
+// rulePathMatches reports whether requestPath matches a rule path and returns
+// the part matched by a trailing wildcard
+func rulePathMatches(rulePath string, requestPath string) (string, bool) {
+	if prefix, ok := strings.CutSuffix(rulePath, "*"); ok {
+		if strings.HasPrefix(requestPath, prefix) {
+			return requestPath[len(prefix):], true
+		}
+		return "", false
+	}
+	return "", requestPath == rulePath
+}
+
+// Register adds a route for each redirect. FileHandler hides the rules file
+// itself, whichever path names it
+func (rules *Rules) Register(router Router) {
+	for _, rule := range rules.Redirects {
+		// Anchored regexes, so paths such as /old.html aren't read as patterns
+		pattern := "^" + regexp.QuoteMeta(rule.From) + "$"
+		if prefix, ok := strings.CutSuffix(rule.From, "*"); ok {
+			pattern = "^" + regexp.QuoteMeta(prefix)
+		}
+		router.AddRoute(pattern, redirectHandler(rule))
+	}
+}
+
+// redirectHandler answers every request with the redirect described by rule
+func redirectHandler(rule RedirectRule) HandlerFunc {
+	return func(request *Request) (*Response, error) {
+		splat, _ := rulePathMatches(rule.From, request.Path)
+
+		response := HTTPBaseResponse(rule.Status, http.StatusText(rule.Status))
+		location := strings.ReplaceAll(rule.To, ":splat", splat)
+		if strings.HasPrefix(location, "/") {
+			// Local targets are inside the server's mount point
+			location = request.BasePath + location
+		}
+		response.Headers["Location"] = location
+		return response, nil
+	}
+}
+
+// Middleware returns a middleware adding the configured headers to responses
+// for matching paths. Headers set by the handler are replaced.
+func (rules *Rules) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			response, err := next(request)
+			if err != nil || response == nil {
+				return response, err
+			}
+
+			for _, rule := range rules.Headers {
+				if _, ok := rulePathMatches(rule.Path, request.Path); ok {
+					if response.Headers == nil {
+						response.Headers = make(map[string]string)
+					}
+					response.Headers[rule.Name] = rule.Value
+				}
+			}
+
+			return response, nil
+		}
+	}
+}
+
+// Apply registers the redirects with the server's router, appends the
+// header middleware to its pipeline and sets the CORS origins and cache
+// lifetime. CORS headers are only sent once s.CORSMiddleware() is in the
+// pipeline.
+func (rules *Rules) Apply(s *HTTPServer) {
+	rules.Register(s.Router)
+	if len(rules.Headers) > 0 {
+		s.Middlewares = append(s.Middlewares, rules.Middleware())
+	}
+	s.Reload(rules.ReloadConfig(""))
+}
+
+// ReloadConfig returns the reloadable settings from the rules, serving
+// directory as the document root
+func (rules *Rules) ReloadConfig(directory string) ReloadConfig {
+	return ReloadConfig{
+		FileDirectory: directory,
+		CORSOrigins:   rules.CORSOrigins,
+		CacheMaxAge:   rules.CacheMaxAge,
+	}
+}
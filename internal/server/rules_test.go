@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	input := `# Site rules
+redirect /old.html /new.html
+redirect /blog/* /posts/:splat 302
+
+header /assets/* Cache-Control: public, max-age=31536000
+header /index.html X-Frame-Options: DENY
+
+cors https://app.example https://admin.example
+cors https://docs.example
+cache-max-age 24h
+`
+
+	rules, err := ParseRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseRules() error = %v", err)
+	}
+
+	expectedRedirects := []RedirectRule{
+		{From: "/old.html", To: "/new.html", Status: 301},
+		{From: "/blog/*", To: "/posts/:splat", Status: 302},
+	}
+	if !reflect.DeepEqual(rules.Redirects, expectedRedirects) {
+		t.Errorf("Redirects = %+v, want %+v", rules.Redirects, expectedRedirects)
+	}
+
+	expectedHeaders := []HeaderRule{
+		{Path: "/assets/*", Name: "Cache-Control", Value: "public, max-age=31536000"},
+		{Path: "/index.html", Name: "X-Frame-Options", Value: "DENY"},
+	}
+	if !reflect.DeepEqual(rules.Headers, expectedHeaders) {
+		t.Errorf("Headers = %+v, want %+v", rules.Headers, expectedHeaders)
+	}
+
+	expectedOrigins := []string{"https://app.example", "https://admin.example", "https://docs.example"}
+	if !reflect.DeepEqual(rules.CORSOrigins, expectedOrigins) {
+		t.Errorf("CORSOrigins = %v, want %v", rules.CORSOrigins, expectedOrigins)
+	}
+	if rules.CacheMaxAge != 24*time.Hour {
+		t.Errorf("CacheMaxAge = %v, want 24h", rules.CacheMaxAge)
+	}
+}
+
+func TestParseRulesMalformed(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expectedErr string
+	}{
+		{"unknown rule", "rewrite /a /b", `line 1: unknown rule "rewrite"`},
+		{"missing target", "# comment\nredirect /a", "line 2: redirect needs"},
+		{"too many fields", "redirect /a /b 301 extra", "line 1: redirect needs"},
+		{"bad status", "redirect /a /b 200", `line 1: invalid redirect status "200"`},
+		{"relative path", "redirect a /b", `line 1: path "a" must start with /`},
+		{"inner wildcard", "header /a/*/b X-Test: 1", "line 1: path \"/a/*/b\" may only end in a wildcard"},
+		{"missing header field", "header /a", "line 1: header needs"},
+		{"header without colon", "header /a X-Test 1", "line 1: invalid header field"},
+		{"header without value", "header /a X-Test:", "line 1: invalid header field"},
+		{"cors without origins", "cors", "line 1: cors needs at least one origin"},
+		{"bad cache max age", "cache-max-age forever", `line 1: invalid cache-max-age "forever"`},
+		{"negative cache max age", "cache-max-age -1h", `line 1: invalid cache-max-age "-1h"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRules(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("Error = %q, want it to contain %q", err.Error(), tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	t.Run("missing file", func(t *testing.T) {
+		rules, err := LoadRules(t.TempDir())
+		if err != nil {
+			t.Fatalf("LoadRules() error = %v", err)
+		}
+		if len(rules.Redirects) != 0 || len(rules.Headers) != 0 {
+			t.Errorf("Expected no rules, got %+v", rules)
+		}
+	})
+
+	t.Run("malformed file", func(t *testing.T) {
+		tempDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(tempDir, RulesFileName), []byte("redirect /a\n"), 0644); err != nil {
+			t.Fatalf("Failed to write rules file: %v", err)
+		}
+
+		_, err := LoadRules(tempDir)
+		if err == nil || !strings.Contains(err.Error(), RulesFileName+": line 1") {
+			t.Errorf("Error = %v, want it to name the file and line", err)
+		}
+	})
+}
+
+func TestRulesApply(t *testing.T) {
+	tempDir := t.TempDir()
+	files := map[string]string{
+		RulesFileName: "redirect /old.html /new.html\n" +
+			"redirect /blog/* /posts/:splat 302\n" +
+			"header /assets/* Cache-Control: public, max-age=31536000\n",
+		"new.html":      "<h1>new</h1>",
+		"assets/app.js": "console.log(1)",
+	}
+	for name, content := range files {
+		path := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	rules, err := LoadRules(tempDir)
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	server := NewHTTPServer(":0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	rules.Apply(server)
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus string
+		checkHeaders   map[string]string
+	}{
+		{"exact redirect", "/old.html", "HTTP/1.1 301 Moved Permanently", map[string]string{"Location": "/new.html"}},
+		{"dot is not a pattern", "/oldxhtml", "HTTP/1.1 404 Not Found", nil},
+		{"wildcard redirect", "/blog/2024/post", "HTTP/1.1 302 Found", map[string]string{"Location": "/posts/2024/post"}},
+		{"header rule", "/assets/app.js", "HTTP/1.1 200 OK", map[string]string{"Cache-Control": "public, max-age=31536000"}},
+		{"no header rule", "/new.html", "HTTP/1.1 200 OK", map[string]string{"Cache-Control": "no-cache"}},
+		{"rules file hidden", "/" + RulesFileName, "HTTP/1.1 404 Not Found", nil},
+		{"rules file hidden behind dot segment", "/./" + RulesFileName, "HTTP/1.1 404 Not Found", nil},
+		{"rules file hidden behind parent segment", "/assets/../" + RulesFileName, "HTTP/1.1 404 Not Found", nil},
+		{"rules file hidden behind encoded segment", "/x/%2E%2E/" + RulesFileName, "HTTP/1.1 404 Not Found", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte("GET " + tt.path + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+			status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+			for key, want := range tt.checkHeaders {
+				if headers[key] != want {
+					t.Errorf("Header %s = %q, want %q", key, headers[key], want)
+				}
+			}
+		})
+	}
+}
@@ -2,24 +2,37 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
 	"os"
 	"os/signal"
+	"reflect"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // DefaultResponseHeaders defines the default headers for all responses
 var DefaultResponseHeaders = map[string]string{
-	"Accept-Ranges":    "bytes",
 	"Cache-Control":    "no-cache",
 	"Connection":       "keep-alive",
 	"Content-Encoding": "identity",
@@ -27,20 +40,90 @@ var DefaultResponseHeaders = map[string]string{
 	"Server":           "tiny-http/0.1",
 }
 
+// DefaultMaxHeaderLineBytes is the longest request or header line accepted
+// when HTTPServer.MaxHeaderLineBytes is not set
+const DefaultMaxHeaderLineBytes = 16 * 1024
+
+// DefaultMaxResponseHeaders is how many headers a response may carry when
+// HTTPServer.MaxResponseHeaders is not set
+const DefaultMaxResponseHeaders = 100
+
+// DefaultMaxHeaderBytes is the largest header block read for TextprotoHeaders
+// when HTTPServer.MaxHeaderBytes is not set
+const DefaultMaxHeaderBytes = 64 * 1024
+
+// DefaultMaxRequestBodyBytes is the largest request body accepted when
+// HTTPServer.MaxRequestBodyBytes is not set
+const DefaultMaxRequestBodyBytes = 1024 * 1024
+
+// Default connection limits used when the corresponding HTTPServer fields are not set
+const (
+	DefaultKeepAliveTimeout     = 30 * time.Second
+	DefaultMaxKeepAliveRequests = 100
+	DefaultHeaderReadTimeout    = 10 * time.Second
+)
+
+// DefaultProtocols are the HTTP versions accepted when HTTPServer.Protocols is not set
+var DefaultProtocols = []string{"HTTP/1.1", "HTTP/1.0"}
+
+// ErrUnsupportedProtocol is returned by parseRequest for HTTP versions the
+// server doesn't accept, including HTTP/0.9 requests; it is answered with 505
+var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+// errHTTP2Preface is returned by parseRequest for the connection preface an
+// HTTP/2 client sends instead of a request, "PRI * HTTP/2.0" and the "SM"
+// line. It wraps ErrUnsupportedProtocol.
+var errHTTP2Preface = fmt.Errorf("%w: HTTP/2 connection preface", ErrUnsupportedProtocol)
+
+// http2PrefaceLine is the request line that opens an HTTP/2 connection preface
+const http2PrefaceLine = "PRI * HTTP/2.0"
+
+// ErrServerClosed is returned by ListenAndServe when the server was shut down before it started listening
+var ErrServerClosed = errors.New("server closed")
+
+// errHeaderLineTooLong is returned by parseRequest when a single line exceeds the limit
+var errHeaderLineTooLong = errors.New("header line too long")
+
+// errHeaderFieldTooLarge is returned by parseRequest when a header field line exceeds the limit
+var errHeaderFieldTooLarge = errors.New("header field too large")
+
+// errHeadersTooLarge is returned by parseRequest when the header block exceeds MaxHeaderBytes
+var errHeadersTooLarge = errors.New("headers too large")
+
+// errMalformedHeader is returned by parseRequest for header lines that can't be parsed
+var errMalformedHeader = errors.New("malformed header")
+
+// errMalformedBody is returned by parseRequest for bodies that can't be decoded
+var errMalformedBody = errors.New("malformed body")
+
+// errBodyTooLarge is returned by parseRequest when Content-Length exceeds the body limit
+var errBodyTooLarge = errors.New("request body too large")
+
 // Router defines the interface for HTTP request routing
 type Router interface {
-	Match(path string) (Handler, bool)
+	Match(path string) (HandlerFunc, bool)
 	AddRoute(pattern string, handler Handler)
 }
 
+// MethodRouter is a Router that can also route by request method, as
+// HTTPRouter does. Routers without it only serve GET and HEAD.
+type MethodRouter interface {
+	Router
+	MatchMethod(method string, path string) (HandlerFunc, bool)
+	Methods(path string) []string
+}
+
 // HTTPRouter implements the Router interface using regex pattern matching
 type HTTPRouter struct {
-	mu       sync.RWMutex
-	handlers map[string]Handler
-	patterns []*compiledPattern
+	mu             sync.RWMutex
+	handlers       map[string]Handler
+	methodHandlers map[string]map[string]Handler
+	patterns       []*compiledPattern
+	fallback       Handler
 }
 
 type compiledPattern struct {
+	method  string
 	pattern string
 	regex   *regexp.Regexp
 	handler Handler
@@ -49,16 +132,37 @@ type compiledPattern struct {
 // NewHTTPRouter creates a new HTTP router
 func NewHTTPRouter() *HTTPRouter {
 	return &HTTPRouter{
-		handlers: make(map[string]Handler),
-		patterns: make([]*compiledPattern, 0),
+		handlers:       make(map[string]Handler),
+		methodHandlers: make(map[string]map[string]Handler),
+		patterns:       make([]*compiledPattern, 0),
 	}
 }
 
 // AddRoute adds a new route to the router
 func (r *HTTPRouter) AddRoute(pattern string, handler Handler) {
+	r.addRoute("", pattern, handler)
+}
+
+// AddMethodRoute adds a route that only matches requests with the given
+// method. Unlike AddRoute it can accept methods other than GET and HEAD,
+// e.g. PUT, PATCH or DELETE for an API.
+func (r *HTTPRouter) AddMethodRoute(method string, pattern string, handler Handler) {
+	r.addRoute(strings.ToUpper(method), pattern, handler)
+}
+
+// addRoute registers handler for pattern, restricted to method unless it's empty
+func (r *HTTPRouter) addRoute(method string, pattern string, handler Handler) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	exact := r.handlers
+	if method != "" {
+		if r.methodHandlers[method] == nil {
+			r.methodHandlers[method] = make(map[string]Handler)
+		}
+		exact = r.methodHandlers[method]
+	}
+
 	// Check if it looks like a regex pattern (contains regex metacharacters)
 	isRegexPattern := strings.ContainsAny(pattern, "^$.*+?{}[]|()")
 
@@ -66,20 +170,29 @@ func (r *HTTPRouter) AddRoute(pattern string, handler Handler) {
 		// Try to compile as regex
 		if re, err := regexp.Compile(pattern); err == nil {
 			r.patterns = append(r.patterns, &compiledPattern{
+				method:  method,
 				pattern: pattern,
 				regex:   re,
 				handler: handler,
 			})
 		} else {
 			// Invalid regex, store as exact match
-			r.handlers[pattern] = handler
+			exact[pattern] = handler
 		}
 	} else {
 		// Plain string, store as exact match
-		r.handlers[pattern] = handler
+		exact[pattern] = handler
 	}
 }
 
+// SetFallback sets the handler used when no exact or regex route matches
+func (r *HTTPRouter) SetFallback(handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = handler
+}
+
 // Match finds a handler for the given path
 func (r *HTTPRouter) Match(path string) (HandlerFunc, bool) {
 	r.mu.RLock()
@@ -91,8 +204,53 @@ func (r *HTTPRouter) Match(path string) (HandlerFunc, bool) {
 	}
 
 	// Check regex patterns
+	for _, cp := range r.patterns {
+		if cp.method == "" && cp.regex.MatchString(path) {
+			return cp.handler.Handle(), true
+		}
+	}
+
+	// Fall back to the default handler, if any
+	if r.fallback != nil {
+		return r.fallback.Handle(), true
+	}
+
+	return nil, false
+}
+
+// unrouted returns the fallback when no route, for any method, matches path
+func (r *HTTPRouter) unrouted(path string) Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.handlers[path]; ok {
+		return nil
+	}
+	for _, handlers := range r.methodHandlers {
+		if _, ok := handlers[path]; ok {
+			return nil
+		}
+	}
 	for _, cp := range r.patterns {
 		if cp.regex.MatchString(path) {
+			return nil
+		}
+	}
+	return r.fallback
+}
+
+// MatchMethod finds a handler registered with AddMethodRoute for the given
+// method and path. Routes added with AddRoute and the fallback aren't considered.
+func (r *HTTPRouter) MatchMethod(method string, path string) (HandlerFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if handler, ok := r.methodHandlers[method][path]; ok {
+		return handler.Handle(), true
+	}
+
+	for _, cp := range r.patterns {
+		if cp.method == method && cp.regex.MatchString(path) {
 			return cp.handler.Handle(), true
 		}
 	}
@@ -100,6 +258,39 @@ func (r *HTTPRouter) Match(path string) (HandlerFunc, bool) {
 	return nil, false
 }
 
+// Methods returns the sorted methods routed for path. Routes added with
+// AddRoute and the fallback count as GET.
+func (r *HTTPRouter) Methods(path string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	set := make(map[string]bool)
+	if _, ok := r.handlers[path]; ok || r.fallback != nil {
+		set["GET"] = true
+	}
+	for method, handlers := range r.methodHandlers {
+		if _, ok := handlers[path]; ok {
+			set[method] = true
+		}
+	}
+	for _, cp := range r.patterns {
+		if cp.regex.MatchString(path) {
+			if cp.method == "" {
+				set["GET"] = true
+			} else {
+				set[cp.method] = true
+			}
+		}
+	}
+
+	methods := make([]string, 0, len(set))
+	for method := range set {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
 // Server defines the interface for HTTP servers
 type Server interface {
 	ListenAndServe(ctx context.Context) error
@@ -108,19 +299,222 @@ type Server interface {
 
 // HTTPServer implements a simple HTTP server
 type HTTPServer struct {
-	Addr          string
-	Router        *HTTPRouter
+	Addr string
+
+	// Router picks the handler for each request. NewHTTPServer installs an
+	// *HTTPRouter serving FileDirectory; any Router may replace it.
+	Router Router
+
 	Middlewares   []Middleware
 	Logger        *slog.Logger
 	FileDirectory string
 
+	// BasePath mounts the server under a path prefix such as "/files", so
+	// "/files/foo.txt" is routed as "/foo.txt". It is stripped before
+	// PreRoutingMiddlewares run and kept in Request.BasePath for handlers
+	// that generate links; requests outside it get a 404.
+	BasePath string
+
+	// PreRoutingMiddlewares wrap routing itself, outermost first, so they can
+	// change a request's Method or Path before a handler is picked, e.g.
+	// MethodOverrideMiddleware. Responses to unrouted requests, such as 404s,
+	// pass through them too.
+	PreRoutingMiddlewares []Middleware
+
+	// MaxHeaderLineBytes limits the length of the request line and of each
+	// header line; longer lines get a 400. Zero means DefaultMaxHeaderLineBytes.
+	MaxHeaderLineBytes int
+
+	// TextprotoHeaders parses header fields with net/textproto instead of
+	// the built-in loop, which also canonicalizes their names. The block is
+	// read in full, up to MaxHeaderBytes, before it is parsed, so the line
+	// limit, framing checks and body reading are unchanged.
+	TextprotoHeaders bool
+
+	// MaxHeaderBytes limits the size of the header block read for
+	// TextprotoHeaders; larger ones get a 431. Zero means
+	// DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+
+	// KeepAliveTimeout is how long an idle keep-alive connection is kept open.
+	// Zero means DefaultKeepAliveTimeout.
+	KeepAliveTimeout time.Duration
+
+	// MaxKeepAliveRequests is how many further requests a connection may make
+	// after the first one. Zero means DefaultMaxKeepAliveRequests.
+	MaxKeepAliveRequests int
+
+	// HeaderReadTimeout bounds the time to receive the request line and
+	// headers, counted from the first byte of a request. It protects against
+	// clients dribbling the head one byte at a time and doesn't apply to the
+	// body. Zero means DefaultHeaderReadTimeout.
+	HeaderReadTimeout time.Duration
+
+	// RequestTimeout caps the whole life of a request: reading it, handling
+	// it and writing the response. A request that runs over has its
+	// connection closed, so a slow handler followed by a stalled client
+	// can't hold it open. It's counted from the start of the connection for
+	// the first request and from the first byte of each later one. Zero
+	// means no limit.
+	RequestTimeout time.Duration
+
+	// MaxRequestBodyBytes is the largest Content-Length accepted; larger
+	// requests get a 413. Zero means DefaultMaxRequestBodyBytes.
+	MaxRequestBodyBytes int64
+
+	// DecodeRequestBodies transparently decompresses request bodies sent
+	// with Content-Encoding gzip or deflate, removing the header and fixing
+	// Content-Length. MaxRequestBodyBytes also bounds the decompressed size,
+	// so a small compressed body can't expand without limit. Bodies in other
+	// encodings are passed on as they are.
+	DecodeRequestBodies bool
+
+	// BodyTooLargeMessage and HeaderTooLargeMessage replace the text of 413
+	// and 431 responses. The exceeded limit is always appended, e.g.
+	// ": max body size 1048576 bytes", so clients can correct the request.
+	BodyTooLargeMessage   string
+	HeaderTooLargeMessage string
+
+	// IdleTimeout makes ListenAndServe run a reaper that closes connections
+	// which haven't read or written anything for this long, including ones
+	// in the middle of a request. Zero disables the reaper.
+	IdleTimeout time.Duration
+
+	// MaxConnsPerIP caps how many connections a single remote IP may have
+	// open at once. Connections beyond it are closed as soon as they arrive,
+	// before anything is read. Zero means no limit.
+	MaxConnsPerIP int
+
+	// StreamFlushBytes flushes streamed response bodies to the client after
+	// at least this many bytes, so slow sources show progress instead of
+	// waiting for the write buffer to fill. Zero only flushes full buffers.
+	StreamFlushBytes int
+
+	// MaxResponseHeaders caps the number of headers written with a response,
+	// guarding against middleware that keeps adding them. Extra headers are
+	// dropped in name order after those needed to frame the response, and a
+	// warning is logged. Zero means DefaultMaxResponseHeaders.
+	MaxResponseHeaders int
+
+	// KeepRawHead stores each request line and header block exactly as
+	// received in Request.RawHead, for debugging and request dumps. It is
+	// off by default as it keeps a copy of every request head.
+	KeepRawHead bool
+
+	// Protocols lists the accepted HTTP versions, e.g. []string{"HTTP/1.1"}.
+	// Requests with any other version get a 505. Nil means DefaultProtocols.
+	Protocols []string
+
+	bytesRead         atomic.Uint64
+	bytesWritten      atomic.Uint64
+	connectionsTotal  atomic.Uint64
+	connectionsReaped atomic.Uint64
+	ready             atomic.Bool // Set once serving, cleared when Shutdown starts
+
+	// Read on every request, so swapped atomically rather than under mu
+	responseHook atomic.Pointer[func(*Request, *Response)]
+	corsOrigins  atomic.Pointer[[]string] // Origins allowed by CORSMiddleware, set by Reload
+
 	mu       sync.Mutex
 	listener net.Listener
 	wg       sync.WaitGroup
 	shutdown bool
-	ctx      context.Context // Add this field
+	closed   chan struct{}             // Closed when Shutdown is called
+	conns    map[*trackedConn]struct{} // Active connections, force-closed on shutdown timeout
+	ipConns  map[string]int            // Open connections per remote IP, for MaxConnsPerIP
+	ctx      context.Context           // Add this field
+
+	startHooks    []func() error
+	shutdownHooks []func()
+
+	files *FileHandler // The fallback NewHTTPServer installed, updated by Reload
+}
+
+// ReloadConfig holds the settings Reload replaces on a running server
+type ReloadConfig struct {
+	// FileDirectory is the new document root of the FileHandler installed by
+	// NewHTTPServer. Empty keeps the current root.
+	FileDirectory string
+
+	// CORSOrigins are the origins allowed by the server's CORSMiddleware,
+	// "*" allowing any. Nil allows none.
+	CORSOrigins []string
+
+	// CacheMaxAge is how long that FileHandler lets clients cache static
+	// assets. Zero means DefaultCacheMaxAge.
+	CacheMaxAge time.Duration
+}
+
+// ServerStats holds cumulative traffic counters for a server
+type ServerStats struct {
+	BytesRead         uint64
+	BytesWritten      uint64
+	ConnectionsTotal  uint64
+	ConnectionsReaped uint64 // Closed by the idle reaper
+}
+
+// trackedConn records when a connection last read or wrote data
+type trackedConn struct {
+	net.Conn
+	lastActive atomic.Int64 // Unix nanoseconds
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.touch()
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.touch()
+	return n, err
+}
+
+func (c *trackedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
 }
 
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    *atomic.Uint64
+	written *atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// rawConn is an in-memory connection that reads a fixed input and
+// collects everything written to it
+type rawConn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *rawConn) Read(p []byte) (int, error)         { return c.in.Read(p) }
+func (c *rawConn) Write(p []byte) (int, error)        { return c.out.Write(p) }
+func (c *rawConn) Close() error                       { return nil }
+func (c *rawConn) LocalAddr() net.Addr                { return rawAddr{} }
+func (c *rawConn) RemoteAddr() net.Addr               { return rawAddr{} }
+func (c *rawConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rawConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rawConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type rawAddr struct{}
+
+func (rawAddr) Network() string { return "raw" }
+func (rawAddr) String() string  { return "raw" }
+
 // NewHTTPServer creates a new HTTP server instance
 func NewHTTPServer(addr string, fileDirectory string, logger *slog.Logger) *HTTPServer {
 	if logger == nil {
@@ -129,24 +523,139 @@ func NewHTTPServer(addr string, fileDirectory string, logger *slog.Logger) *HTTP
 
 	router := NewHTTPRouter()
 
-	// Add file handler for all paths
-	router.AddRoute(`^/.*$`, &FileHandler{
+	// Serve files for any path not claimed by a more specific route
+	files := &FileHandler{
 		FileDirectory: fileDirectory,
 		Logger:        logger,
-	})
+	}
+	router.SetFallback(files)
 
 	return &HTTPServer{
 		Addr:          addr,
 		Router:        router,
 		FileDirectory: fileDirectory,
-		Middlewares: []Middleware{
-			BaseMiddleware,
-			LoggingMiddleware(logger),
-			GzipMiddleware,
-		},
-		Logger: logger,
-		ctx:    context.Background(), // Initialize with background context
+		Middlewares:   DefaultMiddlewares(logger),
+		Logger:        logger,
+		ctx:           context.Background(), // Initialize with background context
+		files:         files,
+	}
+}
+
+// Reload applies config to the running server without dropping connections:
+// requests already being handled finish with the old settings and later ones
+// use the new. A FileDirectory that isn't a directory is refused and nothing
+// changes. Servers not made by NewHTTPServer only get the CORS origins.
+func (s *HTTPServer) Reload(config ReloadConfig) error {
+	if config.FileDirectory != "" {
+		info, err := os.Stat(config.FileDirectory)
+		if err != nil {
+			return fmt.Errorf("cannot access directory %s: %w", config.FileDirectory, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", config.FileDirectory)
+		}
+	}
+
+	origins := slices.Clone(config.CORSOrigins)
+	s.corsOrigins.Store(&origins)
+
+	s.mu.Lock()
+	if config.FileDirectory != "" {
+		s.FileDirectory = config.FileDirectory
+	}
+	files := s.files
+	s.mu.Unlock()
+
+	if files != nil {
+		files.reload(config.FileDirectory, config.CacheMaxAge)
+	}
+	return nil
+}
+
+// CORSMiddleware adds the CORS headers to responses for requests from the
+// origins last passed to Reload. The origins are read on each request, so
+// they can change without a restart. Add it to Middlewares.
+func (s *HTTPServer) CORSMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(request *Request) (*Response, error) {
+			var origins []string
+			if stored := s.corsOrigins.Load(); stored != nil {
+				origins = *stored
+			}
+			return serveCORS(request, next, origins)
+		}
+	}
+}
+
+// DefaultMiddlewares returns the middleware pipeline used by NewHTTPServer,
+// with requests logged to logger
+func DefaultMiddlewares(logger *slog.Logger) []Middleware {
+	return []Middleware{
+		BaseMiddleware,
+		LoggingMiddleware(logger),
+		GzipMiddleware,
+	}
+}
+
+// MiddlewareNames returns the names of the configured middlewares in the order
+// they wrap the handler, outermost first. Middlewares built by a constructor
+// such as LoggingMiddleware are named after the function that made them.
+func (s *HTTPServer) MiddlewareNames() []string {
+	names := make([]string, len(s.Middlewares))
+	for i, m := range s.Middlewares {
+		names[i] = middlewareName(m)
+	}
+	return names
+}
+
+// middlewareName derives a readable name from the function behind m
+func middlewareName(m Middleware) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(m).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+
+	// "github.com/x/pkg.Name.func1" becomes "Name"
+	name := fn.Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 {
+		return name
+	}
+	return parts[1]
+}
+
+// OnStart registers hook to run when ListenAndServe starts, before it
+// listens. Hooks run in the order they were registered; the first to fail
+// stops the rest and makes ListenAndServe return its error without serving.
+func (s *HTTPServer) OnStart(hook func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startHooks = append(s.startHooks, hook)
+}
+
+// OnShutdown registers hook to run once during Shutdown, after active
+// connections have finished or been closed. Hooks run in the order they were
+// registered.
+func (s *HTTPServer) OnShutdown(hook func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// SetResponseHook sets a function applied to every response to a parsed
+// request just before it is written, after the middleware chain has run.
+// It also sees responses the server makes itself, such as 404, 405, 500 and
+// the 503 sent while shutting down, so it suits headers that must be on
+// everything, e.g. a deployment version. Nil removes the hook.
+func (s *HTTPServer) SetResponseHook(hook func(*Request, *Response)) {
+	if hook == nil {
+		s.responseHook.Store(nil)
+		return
 	}
+	s.responseHook.Store(&hook)
 }
 
 // ListenAndServe starts the HTTP server and blocks until shutdown
@@ -154,15 +663,35 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
 	// Store context for use in handleConnection
 	s.mu.Lock()
 	s.ctx = ctx
+	if s.shutdown {
+		// Shutdown hooks have already run, so don't start anything they'd clean up
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	startHooks := slices.Clone(s.startHooks)
 	s.mu.Unlock()
 
+	for _, hook := range startHooks {
+		if err := hook(); err != nil {
+			return fmt.Errorf("start hook failed: %w", err)
+		}
+	}
+
 	listener, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
 	}
 
 	s.mu.Lock()
+	if s.shutdown {
+		// Shutdown ran before the listener existed, don't start serving
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
 	s.listener = listener
+	closed := s.closedChanLocked()
+	s.ready.Store(true)
 	s.mu.Unlock()
 
 	s.Logger.Info("Server starting", "address", listener.Addr().String())
@@ -170,6 +699,12 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
 	// Channel to collect connection handling errors
 	connErrors := make(chan error, 100)
 
+	if s.IdleTimeout > 0 {
+		stopReaper := make(chan struct{})
+		defer close(stopReaper)
+		go s.reapIdleConns(s.IdleTimeout, stopReaper)
+	}
+
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
@@ -183,6 +718,10 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
 					// Context cancelled, stop accepting connections
 					s.Logger.Info("Listener closed due to shutdown")
 					return
+				case <-closed:
+					// Shutdown called directly, stop accepting connections
+					s.Logger.Info("Listener closed due to shutdown")
+					return
 				default:
 					connErrors <- fmt.Errorf("failed to accept connection: %w", err)
 					continue
@@ -191,10 +730,13 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
 
 			// Handle connection in a goroutine
 			s.wg.Add(1)
-			go func(c net.Conn) {
+			go func(c *trackedConn) {
 				defer s.wg.Done()
+				c.touch()
+				s.trackConn(c, true)
+				defer s.trackConn(c, false)
 				s.handleConnection(c)
-			}(conn)
+			}(&trackedConn{Conn: conn})
 		}
 	}()
 
@@ -206,19 +748,130 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		return s.Shutdown(shutdownCtx)
+	case <-closed:
+		// Shutdown was called directly and is draining the connections
+		return ErrServerClosed
 	case err := <-connErrors:
 		return err
 	}
 }
 
-// Shutdown waits for active connections to finish and closes the listener
+// Stats returns the traffic counters accumulated since the server was created
+func (s *HTTPServer) Stats() ServerStats {
+	return ServerStats{
+		BytesRead:         s.bytesRead.Load(),
+		BytesWritten:      s.bytesWritten.Load(),
+		ConnectionsTotal:  s.connectionsTotal.Load(),
+		ConnectionsReaped: s.connectionsReaped.Load(),
+	}
+}
+
+// Ready reports whether the server is accepting traffic: its start hooks
+// have completed, it is listening and Shutdown hasn't been called
+func (s *HTTPServer) Ready() bool {
+	return s.ready.Load()
+}
+
+// isShuttingDown reports whether Shutdown has been called
+func (s *HTTPServer) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shutdown
+}
+
+// closedChanLocked returns the channel closed by Shutdown, s.mu must be held
+func (s *HTTPServer) closedChanLocked() chan struct{} {
+	if s.closed == nil {
+		s.closed = make(chan struct{})
+	}
+	return s.closed
+}
+
+// trackConn adds or removes a connection from the set of active connections
+func (s *HTTPServer) trackConn(conn *trackedConn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// closeConns forcibly closes all active connections
+func (s *HTTPServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// reapIdleConns closes connections idle for longer than idle until stop is closed
+func (s *HTTPServer) reapIdleConns(idle time.Duration, stop <-chan struct{}) {
+	// Check twice per timeout so no connection outlives it by more than half
+	interval := idle / 2
+	if interval <= 0 {
+		interval = idle
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-idle).UnixNano()
+
+			s.mu.Lock()
+			for conn := range s.conns {
+				if conn.lastActive.Load() < cutoff {
+					conn.Close()
+					delete(s.conns, conn)
+					s.connectionsReaped.Add(1)
+					s.Logger.Debug("reaped idle connection", "remote", conn.RemoteAddr().String())
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// ListenerAddr returns the address the server is bound to, or nil if it is not
+// listening yet. Unlike the configured Addr, it reports the actual port when
+// binding to port 0.
+func (s *HTTPServer) ListenerAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting new connections and waits for active ones to finish.
+// Connections still open when ctx is done are closed. It is safe to call
+// concurrently and more than once, e.g. from a signal handler.
 func (s *HTTPServer) Shutdown(ctx context.Context) error {
 	s.mu.Lock()
+	alreadyShutdown := s.shutdown
 	s.shutdown = true
+	s.ready.Store(false)
 	listener := s.listener
+	if !alreadyShutdown {
+		close(s.closedChanLocked())
+	}
 	s.mu.Unlock()
 
-	if listener != nil {
+	if listener != nil && !alreadyShutdown {
 		s.Logger.Info("Closing listener")
 		if err := listener.Close(); err != nil {
 			return fmt.Errorf("failed to close listener: %w", err)
@@ -234,36 +887,148 @@ func (s *HTTPServer) Shutdown(ctx context.Context) error {
 		close(done)
 	}()
 
+	var err error
 	select {
 	case <-done:
 		s.Logger.Info("All connections closed gracefully")
-		return nil
 	case <-ctx.Done():
 		s.Logger.Warn("Shutdown timeout reached, forcing close")
-		return ctx.Err()
+		s.closeConns()
+		err = ctx.Err()
+	}
+
+	// Only the first call runs the hooks, once nothing is being served
+	if !alreadyShutdown {
+		s.mu.Lock()
+		shutdownHooks := slices.Clone(s.shutdownHooks)
+		s.mu.Unlock()
+
+		for _, hook := range shutdownHooks {
+			hook()
+		}
 	}
+
+	return err
+}
+
+// ServeRaw runs raw request bytes through the full connection pipeline
+// without a socket and returns the bytes written back. Several pipelined
+// requests may be given; the connection ends when the input runs out
+func (s *HTTPServer) ServeRaw(raw []byte) []byte {
+	conn := &rawConn{in: bytes.NewReader(raw)}
+	s.handleConnection(conn)
+	return conn.out.Bytes()
 }
 
 // handleConnection processes incoming connections and supports keep-alive
 func (s *HTTPServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	// A panic while parsing, handling or writing only costs this connection
+	defer func() {
+		if r := recover(); r != nil {
+			s.Logger.Error("panic serving connection",
+				"remote_addr", conn.RemoteAddr().String(),
+				"panic", r,
+				"stack", string(debug.Stack()),
+			)
+		}
+	}()
+
+	s.mu.Lock()
+	ctx := s.ctx
+	s.mu.Unlock()
 
-	for {
-		if s.ctx != nil {
+	release, ok := s.acquireIPSlot(conn)
+	if !ok {
+		s.Logger.Warn("refusing connection over the per-IP limit", "remote", conn.RemoteAddr().String())
+		return
+	}
+	defer release()
+
+	s.connectionsTotal.Add(1)
+	counted := &countingConn{Conn: conn, read: &s.bytesRead, written: &s.bytesWritten}
+
+	// One reader for the connection's lifetime: pipelined requests may already
+	// sit in its buffer and would be lost if it were recreated per request
+	reader := bufio.NewReader(counted)
+	writer := bufio.NewWriter(counted)
+
+	keepAliveTimeout := s.KeepAliveTimeout
+	if keepAliveTimeout <= 0 {
+		keepAliveTimeout = DefaultKeepAliveTimeout
+	}
+	maxRequests := s.MaxKeepAliveRequests
+	if maxRequests <= 0 {
+		maxRequests = DefaultMaxKeepAliveRequests
+	}
+	headerTimeout := s.HeaderReadTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultHeaderReadTimeout
+	}
+
+	endRequest := func() bool { return true }
+	defer func() { endRequest() }()
+
+	for served := 0; ; served++ {
+		if ctx != nil {
 			select {
-			case <-s.ctx.Done():
+			case <-ctx.Done():
 				return
 			default:
 			}
 		}
 
-		// Parse the request
-		req, err := s.parseRequest(reader)
+		// Wait for the next request on a kept-alive connection, the header
+		// timeout starts once it begins to arrive
+		if served > 0 {
+			if _, err := reader.Peek(1); err != nil {
+				return
+			}
+		}
+
+		endRequest = s.startRequestTimer(conn)
+
+		// Parse the request head under the header timeout, then give the body
+		// the regular connection deadline
+		conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		req, err := s.parseRequestHead(reader)
+		if err == nil {
+			req.RemoteAddr = conn.RemoteAddr().String()
+			conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+			err = s.readRequestBody(reader, req)
+		}
 		if err != nil {
-			if s.ctx != nil && s.ctx.Err() != nil {
+			if ctx != nil && ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errHeaderLineTooLong) || errors.Is(err, errHeadersTooLarge) || errors.Is(err, errBodyTooLarge) {
+				s.Logger.Warn("rejecting request", "error", err)
+				resp := s.tooLargeResponse(err)
+				resp.Headers["Connection"] = "close"
+				s.writeResponse(writer, resp)
+				return
+			}
+			if errors.Is(err, ErrUnsupportedProtocol) {
+				s.Logger.Warn("rejecting request", "error", err)
+				resp := HTTP505HTTPVersionNotSupported()
+				if errors.Is(err, errHTTP2Preface) {
+					resp.Body = []byte(string(resp.Body) + ": HTTP/2 is not supported, use HTTP/1.1")
+					resp.Headers["Content-Length"] = fmt.Sprintf("%d", len(resp.Body))
+				}
+				resp.Headers["Connection"] = "close"
+				s.writeResponse(writer, resp)
+				return
+			}
+			if errors.Is(err, errMalformedHeader) || errors.Is(err, errMalformedBody) {
+				s.Logger.Warn("rejecting request", "error", err)
+				resp := HTTP400BadRequest()
+				resp.Headers["Connection"] = "close"
+				s.writeResponse(writer, resp)
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.Logger.Warn("dropping connection", "remote", conn.RemoteAddr().String(), "error", err)
 				return
 			}
 			if !isConnectionClosedError(err) {
@@ -272,21 +1037,115 @@ func (s *HTTPServer) handleConnection(conn net.Conn) {
 			return
 		}
 
-		resp := s.handleRequest(req)
+		// Turn away requests that arrive while shutting down so clients retry elsewhere
+		shuttingDown := s.isShuttingDown()
+
+		var resp *Response
+		if shuttingDown {
+			resp = HTTP503ServiceUnavailable()
+		} else {
+			resp = s.handleRequest(req)
+		}
+
+		if responseHook := s.responseHook.Load(); responseHook != nil {
+			(*responseHook)(req, resp)
+		}
 
-		if err := s.writeResponse(writer, resp); err != nil {
-			if s.ctx != nil && s.ctx.Err() != nil {
+		// Advertise the remaining keep-alive budget, or close once it's spent
+		remaining := maxRequests - served
+		closeConn := shuttingDown || remaining <= 0 || strings.ToLower(req.Headers["Connection"]) == "close" || bodyUntilClose(req)
+
+		// A stream of unknown length is chunked for HTTP/1.1 clients; older
+		// ones can't decode that, so the body ends when the connection closes
+		if unknownLength(resp) {
+			if req.Protocol == "HTTP/1.1" {
+				resp.Headers["Transfer-Encoding"] = "chunked"
+				if len(resp.Trailers) > 0 {
+					resp.Headers["Trailer"] = strings.Join(trailerNames(resp.Trailers), ", ")
+				}
+			} else {
+				closeConn = true
+			}
+		}
+		if closeConn {
+			resp.Headers["Connection"] = "close"
+			delete(resp.Headers, "Keep-Alive")
+		} else {
+			resp.Headers["Keep-Alive"] = fmt.Sprintf("timeout=%d, max=%d", int(keepAliveTimeout.Seconds()), remaining)
+		}
+
+		err = s.writeResponse(writer, resp)
+		if !endRequest() {
+			return
+		}
+		if err != nil {
+			if ctx != nil && ctx.Err() != nil {
 				return
 			}
 			s.Logger.Error("Failed to write response", "error", err)
 			return
 		}
 
-		if strings.ToLower(req.Headers["Connection"]) == "close" {
+		if closeConn {
 			return
 		}
 
-		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		conn.SetDeadline(time.Now().Add(keepAliveTimeout))
+	}
+}
+
+// acquireIPSlot counts conn against its remote IP for MaxConnsPerIP, reporting
+// false if the IP already has as many connections open as allowed. The
+// returned func gives the slot back and forgets IPs left without connections.
+func (s *HTTPServer) acquireIPSlot(conn net.Conn) (func(), bool) {
+	if s.MaxConnsPerIP <= 0 {
+		return func() {}, true
+	}
+
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ipConns[ip] >= s.MaxConnsPerIP {
+		return nil, false
+	}
+	if s.ipConns == nil {
+		s.ipConns = make(map[string]int)
+	}
+	s.ipConns[ip]++
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+			delete(s.ipConns, ip)
+		}
+	}, true
+}
+
+// startRequestTimer closes conn once RequestTimeout has passed. The returned
+// function stops the timer and reports false if it had already fired.
+func (s *HTTPServer) startRequestTimer(conn net.Conn) func() bool {
+	if s.RequestTimeout <= 0 {
+		return func() bool { return true }
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	stop := context.AfterFunc(ctx, func() {
+		s.Logger.Warn("request timed out, closing connection",
+			"remote", conn.RemoteAddr().String(),
+			"timeout", s.RequestTimeout,
+		)
+		conn.Close()
+	})
+	return func() bool {
+		defer cancel()
+		return stop()
 	}
 }
 
@@ -303,23 +1162,27 @@ func isConnectionClosedError(err error) bool {
 }
 
 func (s *HTTPServer) handleRequest(request *Request) *Response {
-	if request.Method != "GET" && request.Method != "HEAD" {
-		s.Logger.Warn("unsupported method", "method", request.Method)
-		return HTTP405MethodNotAllowed()
+	// Decode the path once so routing, middleware and handlers all see the same value
+	if request.RawPath == "" {
+		decodedPath, query, err := decodeRequestTarget(request.Path)
+		if err != nil {
+			s.Logger.Warn("invalid request path", "path", request.Path, "error", err)
+			return HTTP400BadRequest()
+		}
+		request.RawPath = request.Path
+		request.Path = decodedPath
+		request.Query = query
 	}
 
-	handler, found := s.Router.Match(request.Path)
-	if !found {
-		s.Logger.Warn("no handler found", "path", request.Path)
-		return HTTP404NotFound()
+	route := s.routeRequest
+	for i := len(s.PreRoutingMiddlewares) - 1; i >= 0; i-- {
+		route = s.PreRoutingMiddlewares[i](route)
 	}
-
-	handlerPipeline := handler
-	for i := len(s.Middlewares) - 1; i >= 0; i-- {
-		handlerPipeline = s.Middlewares[i](handlerPipeline)
+	if base := strings.TrimSuffix(s.BasePath, "/"); base != "" {
+		route = stripBasePath(base, route)
 	}
 
-	response, err := handlerPipeline(request)
+	response, err := route(request)
 	if err != nil {
 		s.Logger.Error("handler error", "error", err, "path", request.Path)
 		return HTTP500InternalServerError()
@@ -336,15 +1199,174 @@ func (s *HTTPServer) handleRequest(request *Request) *Response {
 	return response
 }
 
+// stripBasePath removes base from request paths before calling next,
+// answering requests outside it with a 404
+func stripBasePath(base string, next HandlerFunc) HandlerFunc {
+	if !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	return func(request *Request) (*Response, error) {
+		rest, ok := strings.CutPrefix(request.Path, base)
+		if !ok || (rest != "" && rest[0] != '/') {
+			return HTTP404NotFound(), nil
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		request.Path = rest
+		request.BasePath = base
+		return next(request)
+	}
+}
+
+// routeRequest picks the handler for request and runs it through the middleware pipeline
+func (s *HTTPServer) routeRequest(request *Request) (*Response, error) {
+	// Routes registered for the method come first; everything else only serves
+	// GET and HEAD, and OPTIONS is answered from the routes at the path
+	var handler HandlerFunc
+	found := false
+	if router, ok := s.Router.(MethodRouter); ok {
+		handler, found = router.MatchMethod(request.Method, request.Path)
+	}
+	if !found {
+		switch request.Method {
+		case "GET", "HEAD":
+			handler, found = s.Router.Match(request.Path)
+		case "OPTIONS":
+			// Paths only the FileHandler fallback serves get its answer, which
+			// tells whether the file exists and can be ranged
+			if files, ok := s.fallbackFiles(request.Path); ok {
+				handler, found = files.Handle(), true
+			} else if methods := s.routedMethods(request.Path); len(methods) > 0 {
+				handler, found = optionsHandler(allowHeader(methods)), true
+			}
+		default:
+			s.Logger.Warn("unsupported method", "method", request.Method)
+			response := HTTP405MethodNotAllowed()
+			if methods := s.routedMethods(request.Path); len(methods) > 0 {
+				response.Headers["Allow"] = allowHeader(methods)
+			}
+			return response, nil
+		}
+	}
+	if !found {
+		s.Logger.Warn("no handler found", "path", request.Path)
+		return HTTP404NotFound(), nil
+	}
+
+	handlerPipeline := handler
+	for i := len(s.Middlewares) - 1; i >= 0; i-- {
+		handlerPipeline = s.Middlewares[i](handlerPipeline)
+	}
+
+	return handlerPipeline(request)
+}
+
+// allowHeader formats routed methods for an Allow header: the routed methods
+// in order, then OPTIONS, then HEAD when GET is served
+func allowHeader(methods []string) string {
+	allow := make([]string, 0, len(methods)+2)
+	head := false
+	for _, method := range methods {
+		switch method {
+		case "HEAD":
+			head = true
+		case "OPTIONS":
+		case "GET":
+			head = true
+			allow = append(allow, method)
+		default:
+			allow = append(allow, method)
+		}
+	}
+
+	allow = append(allow, "OPTIONS")
+	if head {
+		allow = append(allow, "HEAD")
+	}
+	return strings.Join(allow, ", ")
+}
+
+// routedMethods returns the methods the router serves for path. Routers
+// that don't route by method serve GET wherever Match finds a handler.
+func (s *HTTPServer) routedMethods(path string) []string {
+	if router, ok := s.Router.(MethodRouter); ok {
+		return router.Methods(path)
+	}
+	if _, found := s.Router.Match(path); found {
+		return []string{"GET"}
+	}
+	return nil
+}
+
+// fallbackFiles returns the router's fallback when it is a FileHandler and no
+// route, for any method, claims path
+func (s *HTTPServer) fallbackFiles(path string) (*FileHandler, bool) {
+	router, ok := s.Router.(interface{ unrouted(path string) Handler })
+	if !ok {
+		return nil, false
+	}
+	files, ok := router.unrouted(path).(*FileHandler)
+	return files, ok
+}
+
+// optionsHandler answers an OPTIONS request with the given Allow header
+func optionsHandler(allow string) HandlerFunc {
+	return func(request *Request) (*Response, error) {
+		return &Response{
+			StatusCode: http.StatusOK,
+			StatusText: http.StatusText(http.StatusOK),
+			Protocol:   request.Protocol,
+			Headers: map[string]string{
+				"Allow":          allow,
+				"Content-Length": "0",
+			},
+		}, nil
+	}
+}
+
 func (s *HTTPServer) parseRequest(reader *bufio.Reader) (*Request, error) {
-	startLine, err := reader.ReadString('\n')
+	request, err := s.parseRequestHead(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.readRequestBody(reader, request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// parseRequestHead reads the request line and headers
+func (s *HTTPServer) parseRequestHead(reader *bufio.Reader) (*Request, error) {
+	maxLine := s.MaxHeaderLineBytes
+	if maxLine <= 0 {
+		maxLine = DefaultMaxHeaderLineBytes
+	}
+
+	var raw *bytes.Buffer
+	if s.KeepRawHead {
+		raw = &bytes.Buffer{}
+	}
+
+	startLine, err := readLine(reader, maxLine, raw)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read request line: %w", err)
 	}
 
-	startLine = strings.TrimRight(startLine, "\r\n")
+	// HTTP/2 clients with prior knowledge skip HTTP/1.1 entirely
+	if startLine == http2PrefaceLine {
+		return nil, errHTTP2Preface
+	}
+
 	parts := strings.Split(startLine, " ")
-	if len(parts) != 3 {
+
+	// HTTP/0.9 requests are just "GET /path" with no version
+	if len(parts) == 2 && parts[0] == "GET" && parts[1] != "" {
+		return nil, fmt.Errorf("%w: HTTP/0.9", ErrUnsupportedProtocol)
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
 		return nil, fmt.Errorf("invalid request line: %s", startLine)
 	}
 
@@ -355,48 +1377,368 @@ func (s *HTTPServer) parseRequest(reader *bufio.Reader) (*Request, error) {
 		Headers:  make(map[string]string),
 	}
 
-	if request.Protocol != "HTTP/1.1" && request.Protocol != "HTTP/1.0" {
-		return nil, fmt.Errorf("unsupported protocol: %s", request.Protocol)
+	if !strings.HasPrefix(request.Protocol, "HTTP/") {
+		return nil, fmt.Errorf("invalid request line: %s", startLine)
+	}
+	protocols := s.Protocols
+	if protocols == nil {
+		protocols = DefaultProtocols
+	}
+	if !slices.Contains(protocols, request.Protocol) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProtocol, request.Protocol)
+	}
+
+	readHeaders := readHeaderFields
+	if s.TextprotoHeaders {
+		readHeaders = s.readTextprotoHeaders
+	}
+	hostCount, err := readHeaders(reader, request, maxLine, raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		request.RawHead = raw.Bytes()
+	}
+
+	if request.Protocol == "HTTP/1.1" && hostCount != 1 {
+		if hostCount == 0 {
+			return nil, fmt.Errorf("%w: missing Host header", errMalformedHeader)
+		}
+		return nil, fmt.Errorf("%w: %d Host headers", errMalformedHeader, hostCount)
 	}
 
+	return request, nil
+}
+
+// readHeaderFields reads header lines into request.Headers up to the blank
+// line ending them, returning how many Host fields were seen
+func readHeaderFields(reader *bufio.Reader, request *Request, maxLine int, raw *bytes.Buffer) (int, error) {
+	var lastKey string
+	hostCount := 0
 	for {
-		line, err := reader.ReadString('\n')
+		line, err := readLine(reader, maxLine, raw)
+		if errors.Is(err, errHeaderLineTooLong) {
+			return 0, fmt.Errorf("%w: %w", errHeaderFieldTooLarge, err)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read header: %w", err)
+			return 0, fmt.Errorf("failed to read header: %w", err)
 		}
 
-		line = strings.TrimRight(line, "\r\n")
 		if line == "" {
 			break // End of headers
 		}
 
-		colonIdx := strings.Index(line, ":")
-		if colonIdx == -1 {
-			continue // Skip malformed headers
+		// A line starting with whitespace is an obsolete fold continuing the
+		// previous header's value (RFC 9112 section 5.2), unfold it with a space
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastKey == "" || strings.ContainsAny(line, "\r\x00") {
+				return 0, fmt.Errorf("%w: continuation line %q", errMalformedHeader, line)
+			}
+			if folded := strings.TrimSpace(line); folded != "" {
+				if request.Headers[lastKey] == "" {
+					request.Headers[lastKey] = folded
+				} else {
+					request.Headers[lastKey] += " " + folded
+				}
+			}
+			continue
+		}
+
+		// Field names must be tokens, so "Host :" can't be read differently
+		// from "Host:" by a proxy in front of us; values can't hide a bare CR
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !isToken(key) || strings.ContainsAny(value, "\r\x00") {
+			return 0, fmt.Errorf("%w: %q", errMalformedHeader, line)
+		}
+
+		value = strings.TrimSpace(value)
+
+		// Framing must be unambiguous: repeated or list-valued Content-Length
+		// is only accepted when every value agrees, and it is stored under
+		// its canonical name so the body is always read by the same rules
+		if strings.EqualFold(key, "Content-Length") {
+			normalized, ok := normalizeContentLength(value)
+			if prev, seen := request.Headers["Content-Length"]; !ok || (seen && prev != normalized) {
+				return 0, fmt.Errorf("%w: conflicting Content-Length values", errMalformedHeader)
+			}
+			key, value = "Content-Length", normalized
+		}
+
+		// Host is stored under its canonical name so a repeat in another case
+		// can't go unnoticed; HTTP/1.1 allows exactly one (RFC 9112 section 3.2)
+		if strings.EqualFold(key, "Host") {
+			key = "Host"
+			hostCount++
 		}
 
-		key := strings.TrimSpace(line[:colonIdx])
-		value := strings.TrimSpace(line[colonIdx+1:])
 		request.Headers[key] = value
+		lastKey = key
+	}
+
+	return hostCount, nil
+}
+
+// readTextprotoHeaders reads the header block, bounded by MaxHeaderBytes, and
+// parses it with net/textproto, returning how many Host fields it held
+func (s *HTTPServer) readTextprotoHeaders(reader *bufio.Reader, request *Request, maxLine int, raw *bytes.Buffer) (int, error) {
+	maxBytes := s.maxHeaderBytes()
+
+	// Collect the raw block first so textproto can't read past it into the body
+	var block bytes.Buffer
+	for {
+		line, err := readLine(reader, maxLine, raw)
+		if errors.Is(err, errHeaderLineTooLong) {
+			return 0, fmt.Errorf("%w: %w", errHeaderFieldTooLarge, err)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read header: %w", err)
+		}
+		if block.Len()+len(line)+2 > maxBytes {
+			return 0, fmt.Errorf("%w: more than %d bytes", errHeadersTooLarge, maxBytes)
+		}
+		if strings.ContainsAny(line, "\r\x00") {
+			return 0, fmt.Errorf("%w: %q", errMalformedHeader, line)
+		}
+
+		block.WriteString(line)
+		block.WriteString("\r\n")
+		if line == "" {
+			break
+		}
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(&block)).ReadMIMEHeader()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errMalformedHeader, err)
+	}
+
+	for key, values := range header {
+		// Repeated Content-Length fields must agree, as in readHeaderFields
+		if key == "Content-Length" {
+			normalized, ok := normalizeContentLength(strings.Join(values, ","))
+			if !ok {
+				return 0, fmt.Errorf("%w: conflicting Content-Length values", errMalformedHeader)
+			}
+			values = []string{normalized}
+		}
+
+		// Like the built-in loop, the last of repeated fields wins
+		request.Headers[key] = values[len(values)-1]
+	}
+
+	return len(header["Host"]), nil
+}
+
+// maxHeaderBytes returns the configured header block limit or its default
+func (s *HTTPServer) maxHeaderBytes() int {
+	if s.MaxHeaderBytes > 0 {
+		return s.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+// normalizeContentLength collapses a Content-Length list such as "5, 5" to a
+// single value, reporting false if the members differ
+func normalizeContentLength(value string) (string, bool) {
+	members := strings.Split(value, ",")
+	first := strings.TrimSpace(members[0])
+	for _, member := range members[1:] {
+		if strings.TrimSpace(member) != first {
+			return "", false
+		}
+	}
+	return first, true
+}
+
+// isToken reports whether s is a non-empty RFC 9110 token, the syntax of header field names
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
 	}
+	return true
+}
 
+// readRequestBody reads the body announced by the Content-Length header, if
+// any, or an HTTP/1.0 body delimited by the connection closing
+func (s *HTTPServer) readRequestBody(reader *bufio.Reader, request *Request) error {
 	if clHeader, ok := request.Headers["Content-Length"]; ok {
 		cl, err := strconv.Atoi(clHeader)
 		if err != nil || cl < 0 {
-			return nil, fmt.Errorf("invalid content-length: %s", clHeader)
+			return fmt.Errorf("invalid content-length: %s", clHeader)
+		}
+		if int64(cl) > s.maxRequestBodyBytes() {
+			return fmt.Errorf("%w: content-length %d", errBodyTooLarge, cl)
 		}
 
 		if cl > 0 {
 			body := make([]byte, cl)
 			_, err := io.ReadFull(reader, body)
 			if err != nil {
-				return nil, fmt.Errorf("failed to read body: %w", err)
+				return fmt.Errorf("failed to read body: %w", err)
 			}
 			request.Body = body
 		}
+	} else if bodyUntilClose(request) {
+		// Read one byte past the limit to tell a full body from an oversized one
+		limit := s.maxRequestBodyBytes()
+		body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+		if err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		if int64(len(body)) > limit {
+			return fmt.Errorf("%w: more than %d bytes before close", errBodyTooLarge, limit)
+		}
+		if len(body) > 0 {
+			request.Body = body
+		}
 	}
 
-	return request, nil
+	if s.DecodeRequestBodies && request.Body != nil {
+		return s.decodeRequestBody(request)
+	}
+	return nil
+}
+
+// decodeRequestBody replaces a gzip or deflate encoded body with its
+// decompressed content, reading at most the request body limit of it
+func (s *HTTPServer) decodeRequestBody(request *Request) error {
+	var decoder io.Reader
+	var err error
+	encoding := strings.ToLower(strings.TrimSpace(request.Headers["Content-Encoding"]))
+	switch encoding {
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(bytes.NewReader(request.Body))
+	case "deflate":
+		// Deflate should be zlib wrapped, but some clients send raw deflate data
+		decoder, err = zlib.NewReader(bytes.NewReader(request.Body))
+		if errors.Is(err, zlib.ErrHeader) {
+			decoder, err = flate.NewReader(bytes.NewReader(request.Body)), nil
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errMalformedBody, encoding, err)
+	}
+
+	limit := s.maxRequestBodyBytes()
+	body, err := io.ReadAll(io.LimitReader(decoder, limit+1))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errMalformedBody, encoding, err)
+	}
+	if int64(len(body)) > limit {
+		return fmt.Errorf("%w: more than %d bytes decompressed", errBodyTooLarge, limit)
+	}
+
+	request.Body = body
+	delete(request.Headers, "Content-Encoding")
+	request.Headers["Content-Length"] = strconv.Itoa(len(body))
+	return nil
+}
+
+// bodyUntilClose reports whether request is an HTTP/1.0 request whose body,
+// lacking a Content-Length, runs until the client closes the connection
+func bodyUntilClose(request *Request) bool {
+	if request.Protocol != "HTTP/1.0" {
+		return false
+	}
+	if _, ok := request.Headers["Content-Length"]; ok {
+		return false
+	}
+	switch request.Method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+// maxRequestBodyBytes returns the configured body limit or its default
+func (s *HTTPServer) maxRequestBodyBytes() int64 {
+	if s.MaxRequestBodyBytes > 0 {
+		return s.MaxRequestBodyBytes
+	}
+	return DefaultMaxRequestBodyBytes
+}
+
+// tooLargeResponse builds the response for a request rejected by a size
+// limit, naming the limit that was exceeded
+func (s *HTTPServer) tooLargeResponse(err error) *Response {
+	maxLine := s.MaxHeaderLineBytes
+	if maxLine <= 0 {
+		maxLine = DefaultMaxHeaderLineBytes
+	}
+
+	var resp *Response
+	var message, limit string
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		resp = HTTP413RequestEntityTooLarge()
+		message = s.BodyTooLargeMessage
+		limit = fmt.Sprintf("max body size %d bytes", s.maxRequestBodyBytes())
+	case errors.Is(err, errHeaderFieldTooLarge):
+		// An oversized header line stays a 400, though it names the limit too
+		resp = HTTP400BadRequest()
+		limit = fmt.Sprintf("max header line %d bytes", maxLine)
+	case errors.Is(err, errHeadersTooLarge):
+		resp = HTTP431RequestHeaderFieldsTooLarge()
+		message = s.HeaderTooLargeMessage
+		limit = fmt.Sprintf("max header size %d bytes", s.maxHeaderBytes())
+	default:
+		// An oversized request line isn't a header field, so it stays a plain 400
+		return HTTP400BadRequest()
+	}
+
+	if message == "" {
+		message = string(resp.Body)
+	}
+	resp.Body = []byte(message + ": " + limit)
+	resp.Headers["Content-Length"] = fmt.Sprintf("%d", len(resp.Body))
+	return resp
+}
+
+// readLine reads a single CRLF or LF terminated line without the line ending,
+// failing with errHeaderLineTooLong once more than maxLen bytes have been read.
+// If raw isn't nil the line is also appended to it exactly as received.
+func readLine(reader *bufio.Reader, maxLen int, raw *bytes.Buffer) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if raw != nil {
+			raw.Write(chunk)
+		}
+		line = append(line, chunk...)
+
+		switch {
+		case err == nil:
+			line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+			if len(line) > maxLen {
+				return "", errHeaderLineTooLong
+			}
+			return string(line), nil
+		case err == bufio.ErrBufferFull:
+			// Allow for the CR of a line ending split across reads
+			if len(line) > maxLen+1 {
+				return "", errHeaderLineTooLong
+			}
+		case err == io.EOF && len(line) > 0:
+			// A last line without an ending, the next read reports EOF
+			if len(line) > maxLen {
+				return "", errHeaderLineTooLong
+			}
+			return string(line), nil
+		default:
+			return "", err
+		}
+	}
 }
 
 // writeResponse writes an HTTP response to a writer
@@ -407,8 +1749,14 @@ func (s *HTTPServer) writeResponse(writer *bufio.Writer, response *Response) err
 		return err
 	}
 
+	s.capResponseHeaders(response)
+
 	// Write headers
+	bodyless := bodylessStatus(response.StatusCode)
 	for key, value := range response.Headers {
+		if bodyless && key == "Content-Length" {
+			continue
+		}
 		_, err := fmt.Fprintf(writer, "%s: %s\r\n", key, value)
 		if err != nil {
 			return err
@@ -427,14 +1775,22 @@ func (s *HTTPServer) writeResponse(writer *bufio.Writer, response *Response) err
 	}
 
 	// Write body
-	if response.Reader != nil {
+	if bodyless {
+		// Whatever a handler attached, 204 and 304 responses end at the headers
+		if response.Reader != nil {
+			response.Reader.Close()
+		}
+	} else if response.Reader != nil {
 		// Stream from reader for large files
 		defer response.Reader.Close()
 
+		if response.Headers["Transfer-Encoding"] == "chunked" {
+			return s.writeChunked(writer, response)
+		}
+
 		// Stream directly to the writer (which is already *bufio.Writer)
 		// Copy in chunks to avoid loading entire file into memory
-		_, err := io.Copy(writer, response.Reader)
-		if err != nil {
+		if err := copyFlushing(writer, writer, response.Reader, s.StreamFlushBytes); err != nil {
 			return err
 		}
 
@@ -451,6 +1807,127 @@ func (s *HTTPServer) writeResponse(writer *bufio.Writer, response *Response) err
 	return writer.Flush()
 }
 
+// essentialResponseHeaders frame or redirect a response, so they are kept
+// ahead of any other header when MaxResponseHeaders is reached
+var essentialResponseHeaders = []string{
+	"Content-Length",
+	"Transfer-Encoding",
+	"Trailer",
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Range",
+	"Connection",
+	"Keep-Alive",
+	"Location",
+}
+
+// capResponseHeaders drops headers beyond MaxResponseHeaders. Essential
+// headers are always kept; the rest are kept in name order until the cap.
+func (s *HTTPServer) capResponseHeaders(response *Response) {
+	limit := s.MaxResponseHeaders
+	if limit <= 0 {
+		limit = DefaultMaxResponseHeaders
+	}
+	if len(response.Headers) <= limit {
+		return
+	}
+
+	kept := 0
+	for _, name := range essentialResponseHeaders {
+		if _, ok := response.Headers[name]; ok {
+			kept++
+		}
+	}
+
+	names := make([]string, 0, len(response.Headers))
+	for name := range response.Headers {
+		if !slices.Contains(essentialResponseHeaders, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	dropped := 0
+	for _, name := range names {
+		if kept < limit {
+			kept++
+			continue
+		}
+		delete(response.Headers, name)
+		dropped++
+	}
+
+	s.Logger.Warn("dropped response headers over the limit", "limit", limit, "dropped", dropped)
+}
+
+// writeChunked streams the response body with chunked transfer coding,
+// followed by its trailers once the body has been read to the end
+func (s *HTTPServer) writeChunked(writer *bufio.Writer, response *Response) error {
+	chunked := httputil.NewChunkedWriter(writer)
+	if err := copyFlushing(chunked, writer, response.Reader, s.StreamFlushBytes); err != nil {
+		return err
+	}
+
+	// Close writes the last chunk; trailers and the final CRLF follow it
+	if err := chunked.Close(); err != nil {
+		return err
+	}
+	for _, name := range trailerNames(response.Trailers) {
+		if _, err := fmt.Fprintf(writer, "%s: %s\r\n", name, response.Trailers[name]); err != nil {
+			return err
+		}
+	}
+	if _, err := writer.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// trailerNames returns the names of trailers, sorted
+func trailerNames(trailers map[string]string) []string {
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyFlushing copies src to dst, flushing w, the buffer beneath dst, whenever
+// at least every bytes have been written since the last flush. every <= 0
+// leaves flushing to w.
+func copyFlushing(dst io.Writer, w *bufio.Writer, src io.Reader, every int) error {
+	if every <= 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	pending := 0
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			pending += n
+			if pending >= every {
+				if ferr := w.Flush(); ferr != nil {
+					return ferr
+				}
+				pending = 0
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // copyHeaders creates a copy of a header map
 func copyHeaders(src map[string]string) map[string]string {
 	dst := make(map[string]string, len(src))
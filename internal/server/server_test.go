@@ -3,13 +3,23 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -31,6 +41,41 @@ func (h *testHandler) Handle() HandlerFunc {
 	}
 }
 
+// readTestResponse reads a single response with a Content-Length body from reader
+func readTestResponse(reader *bufio.Reader) (string, map[string]string, []byte, error) {
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	headers := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", nil, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			headers[key] = strings.TrimSpace(value)
+		}
+	}
+
+	var body []byte
+	if cl := headers["Content-Length"]; cl != "" {
+		var n int
+		fmt.Sscanf(cl, "%d", &n)
+		body = make([]byte, n)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	return strings.TrimRight(statusLine, "\r\n"), headers, body, nil
+}
+
 // TestHTTPRouter tests the router functionality
 func TestHTTPRouter(t *testing.T) {
 	router := NewHTTPRouter()
@@ -76,6 +121,96 @@ func TestHTTPRouter(t *testing.T) {
 }
 
 // Update any tests that create HTTPServer instances directly
+// TestMethodRoutes tests that method routes receive non-GET requests with their body
+func TestMethodRoutes(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var received []byte
+	server.Router.(*HTTPRouter).AddMethodRoute("PATCH", "^/items/[0-9]+$", HandlerFunc(func(req *Request) (*Response, error) {
+		received = req.Body
+		return HTTPBaseResponse(200, "OK"), nil
+	}))
+	server.Router.(*HTTPRouter).AddMethodRoute("delete", "/items", HandlerFunc(func(req *Request) (*Response, error) {
+		return HTTPBaseResponse(204, "No Content"), nil
+	}))
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+	}{
+		{"patch with body", "PATCH /items/7 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 12\r\n\r\n{\"name\":\"x\"}", "HTTP/1.1 200 OK"},
+		{"lowercase registration", "DELETE /items HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 204 No Content"},
+		{"unregistered method", "PUT /items/7 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 405 Method Not Allowed"},
+		{"get skips method routes", "GET /items/7 HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+		})
+	}
+
+	if string(received) != `{"name":"x"}` {
+		t.Errorf("PATCH handler received body %q", received)
+	}
+}
+
+// TestAutomaticOptions tests that OPTIONS is answered from the routes registered at a path
+func TestAutomaticOptions(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	router := server.Router.(*HTTPRouter)
+	router.SetFallback(nil)
+
+	ok := HandlerFunc(func(req *Request) (*Response, error) {
+		return HTTPBaseResponse(200, "OK"), nil
+	})
+	router.AddMethodRoute("GET", "/api/items", ok)
+	router.AddMethodRoute("POST", "/api/items", ok)
+	router.AddMethodRoute("DELETE", "^/api/items/[0-9]+$", ok)
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+		expectedAllow  string
+	}{
+		{"get and post", "OPTIONS /api/items HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 OK", "GET, POST, OPTIONS, HEAD"},
+		{"regex route without get", "OPTIONS /api/items/3 HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 OK", "DELETE, OPTIONS"},
+		{"unknown path", "OPTIONS /nowhere HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 404 Not Found", ""},
+		{"405 lists routed methods", "PUT /api/items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 405 Method Not Allowed", "GET, POST, OPTIONS, HEAD"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+			if tt.expectedAllow != "" {
+				if headers["Allow"] != tt.expectedAllow {
+					t.Errorf("Allow = %q, want %q", headers["Allow"], tt.expectedAllow)
+				}
+				if tt.expectedStatus == "HTTP/1.1 200 OK" && len(body) != 0 {
+					t.Errorf("Expected empty OPTIONS body, got %q", body)
+				}
+			}
+		})
+	}
+}
+
 func TestParseRequest(t *testing.T) {
 	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
 
@@ -104,6 +239,7 @@ func TestParseRequest(t *testing.T) {
 		{
 			name: "request with body",
 			input: "POST /test HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
 				"Content-Length: 11\r\n" +
 				"\r\n" +
 				"Hello World",
@@ -112,6 +248,7 @@ func TestParseRequest(t *testing.T) {
 				Path:     "/test",
 				Protocol: "HTTP/1.1",
 				Headers: map[string]string{
+					"Host":           "localhost",
 					"Content-Length": "11",
 				},
 				Body: []byte("Hello World"),
@@ -127,6 +264,98 @@ func TestParseRequest(t *testing.T) {
 			input:   "GET /test HTTP/2.0\r\n\r\n",
 			wantErr: true,
 		},
+		{
+			name: "obsolete line folding",
+			input: "GET /test HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"X-Folded: first\r\n" +
+				" second\r\n" +
+				"\tthird\r\n" +
+				"X-Empty:\r\n" +
+				"\r\n",
+			want: &Request{
+				Method:   "GET",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Host":     "localhost",
+					"X-Folded": "first second third",
+					"X-Empty":  "",
+				},
+			},
+		},
+		{
+			name:    "header without colon",
+			input:   "GET /test HTTP/1.1\r\nNoColon\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "whitespace before colon",
+			input:   "GET /test HTTP/1.1\r\nHost : localhost\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty header name",
+			input:   "GET /test HTTP/1.1\r\n: value\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "continuation before first header",
+			input:   "GET /test HTTP/1.1\r\n leading\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty method",
+			input:   " /test HTTP/1.1\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name: "identical duplicate Content-Length",
+			input: "POST /test HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"Content-Length: 5\r\n" +
+				"content-length: 5\r\n" +
+				"\r\n" +
+				"hello",
+			want: &Request{
+				Method:   "POST",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Host":           "localhost",
+					"Content-Length": "5",
+				},
+				Body: []byte("hello"),
+			},
+		},
+		{
+			name: "identical Content-Length list",
+			input: "POST /test HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"Content-Length: 5, 5\r\n" +
+				"\r\n" +
+				"hello",
+			want: &Request{
+				Method:   "POST",
+				Path:     "/test",
+				Protocol: "HTTP/1.1",
+				Headers: map[string]string{
+					"Host":           "localhost",
+					"Content-Length": "5",
+				},
+				Body: []byte("hello"),
+			},
+		},
+		{
+			name:    "differing duplicate Content-Length",
+			input:   "POST /test HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+			wantErr: true,
+		},
+		{
+			name:    "differing Content-Length list",
+			input:   "POST /test HTTP/1.1\r\nContent-Length: 5, 6\r\n\r\nhello!",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -152,9 +381,157 @@ func TestParseRequest(t *testing.T) {
 				if string(got.Body) != string(tt.want.Body) {
 					t.Errorf("Body = %v, want %v", string(got.Body), string(tt.want.Body))
 				}
+				for key, value := range tt.want.Headers {
+					if got.Headers[key] != value {
+						t.Errorf("Header %s = %q, want %q", key, got.Headers[key], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMalformedHeaderRejected tests that a malformed header gets a 400 and closes the connection
+func TestMalformedHeaderRejected(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"whitespace before colon", "GET / HTTP/1.1\r\nHost : localhost\r\n\r\n"},
+		{"conflicting Content-Length", "GET / HTTP/1.1\r\nContent-Length: 0\r\nContent-Length: 4\r\n\r\nGET "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if status != "HTTP/1.1 400 Bad Request" {
+				t.Errorf("Expected 400 Bad Request, got %q", status)
+			}
+			if headers["Connection"] != "close" {
+				t.Errorf("Expected Connection: close, got %q", headers["Connection"])
+			}
+		})
+	}
+}
+
+// TestProtocolVersions tests the accepted HTTP versions and the 505 for the rest
+func TestProtocolVersions(t *testing.T) {
+	tests := []struct {
+		name           string
+		protocols      []string
+		request        string
+		expectedStatus string
+	}{
+		{"HTTP/1.1 by default", nil, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 404 Not Found"},
+		{"HTTP/1.0 by default", nil, "GET / HTTP/1.0\r\n\r\n", "HTTP/1.1 404 Not Found"},
+		{"HTTP/2.0 rejected", nil, "GET / HTTP/2.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported"},
+		{"HTTP/0.9 rejected", nil, "GET /\r\n", "HTTP/1.1 505 HTTP Version Not Supported"},
+		{"HTTP/1.0 disabled", []string{"HTTP/1.1"}, "GET / HTTP/1.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported"},
+		{"HTTP/1.1 still accepted", []string{"HTTP/1.1"}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			server.Protocols = tt.protocols
+
+			out := server.ServeRaw([]byte(tt.request))
+			status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
 			}
 		})
 	}
+
+	// parseRequest reports the sentinel so callers can tell it from malformed input
+	server := &HTTPServer{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	_, err := server.parseRequest(bufio.NewReader(strings.NewReader("GET / HTTP/3\r\n\r\n")))
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("Expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
+
+// TestHTTP2Preface tests that an HTTP/2 connection preface gets a 505
+// explaining that only HTTP/1.x is spoken
+func TestHTTP2Preface(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	out := server.ServeRaw([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if status != "HTTP/1.1 505 HTTP Version Not Supported" {
+		t.Errorf("Status = %q, want a 505", status)
+	}
+	if !strings.Contains(string(body), "use HTTP/1.1") {
+		t.Errorf("Body = %q, want advice to use HTTP/1.1", body)
+	}
+	if headers["Connection"] != "close" {
+		t.Errorf("Connection = %q, want close", headers["Connection"])
+	}
+	if strings.Count(string(out), "HTTP/1.1 ") != 1 {
+		t.Errorf("Expected a single response to the preface, got %q", out)
+	}
+
+	// parseRequest reports the preface as an unsupported protocol
+	_, err = server.parseRequest(bufio.NewReader(strings.NewReader("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")))
+	if !errors.Is(err, errHTTP2Preface) || !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("Expected the HTTP/2 preface error, got %v", err)
+	}
+}
+
+// FuzzParseRequest checks that parseRequest never panics and only returns
+// well-formed requests
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	f.Add([]byte("POST /upload HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("GET /fold HTTP/1.1\r\nX-A: one\r\n two\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nX-Empty:\r\n:\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\nHost: lf-only\n\n"))
+
+	server := &HTTPServer{
+		Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		MaxHeaderLineBytes:  256,
+		MaxRequestBodyBytes: 1024,
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := server.parseRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			if req != nil {
+				t.Errorf("parseRequest returned a request along with error %v", err)
+			}
+			return
+		}
+
+		if req.Method == "" || req.Path == "" {
+			t.Errorf("Empty method or path in %+v", req)
+		}
+		if req.Protocol != "HTTP/1.1" && req.Protocol != "HTTP/1.0" {
+			t.Errorf("Unexpected protocol %q", req.Protocol)
+		}
+		for key := range req.Headers {
+			if key == "" || strings.ContainsAny(key, " \t\r\n:") {
+				t.Errorf("Invalid header name %q", key)
+			}
+		}
+		if cl, ok := req.Headers["Content-Length"]; ok {
+			if n, convErr := strconv.Atoi(cl); convErr != nil || n != len(req.Body) {
+				t.Errorf("Body length %d doesn't match Content-Length %q", len(req.Body), cl)
+			}
+		}
+	})
 }
 
 // Update any other tests that create server instances directly
@@ -354,6 +731,26 @@ func TestFileHandler(t *testing.T) {
 	}
 }
 
+// TestMiddlewareNames tests inspecting the configured middleware chain
+func TestMiddlewareNames(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	names := server.MiddlewareNames()
+	expected := []string{"BaseMiddleware", "LoggingMiddlewareWithConfig", "GzipMiddleware"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("MiddlewareNames() = %v, want %v", names, expected)
+	}
+
+	server.Middlewares = append(server.Middlewares, SecurityMiddleware, CORSMiddleware([]string{"*"}))
+	names = server.MiddlewareNames()
+	if names[0] != "BaseMiddleware" {
+		t.Errorf("Expected BaseMiddleware first, got %v", names)
+	}
+	if names[3] != "SecurityMiddleware" || names[4] != "CORSMiddleware" {
+		t.Errorf("Unexpected names for appended middlewares: %v", names)
+	}
+}
+
 // TestServerShutdown tests graceful shutdown
 func TestServerShutdown(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -372,15 +769,12 @@ func TestServerShutdown(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Get the actual address
-	server.mu.Lock()
-	listener := server.listener
-	server.mu.Unlock()
-
-	if listener == nil {
+	listenerAddr := server.ListenerAddr()
+	if listenerAddr == nil {
 		t.Fatal("Server listener is nil")
 	}
 
-	addr := listener.Addr().String()
+	addr := listenerAddr.String()
 
 	// Make a connection
 	conn, err := net.Dial("tcp", addr)
@@ -406,75 +800,293 @@ func TestServerShutdown(t *testing.T) {
 	}
 }
 
-// Benchmark tests
-func BenchmarkHTTPRouterMatch(b *testing.B) {
-	router := NewHTTPRouter()
+// TestServerListenerAddr tests discovering the ephemeral port after binding to :0
+func TestServerListenerAddr(t *testing.T) {
+	server := NewHTTPServer(":0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
 
-	// Add various routes
-	for i := 0; i < 100; i++ {
-		router.AddRoute(fmt.Sprintf("/path%d", i), &testHandler{response: "test"})
+	if addr := server.ListenerAddr(); addr != nil {
+		t.Fatalf("ListenerAddr() = %v before listening, want nil", addr)
 	}
-	router.AddRoute(`^/api/.*$`, &testHandler{response: "api"})
-	router.AddRoute(`^/files/.*\.(jpg|png)$`, &testHandler{response: "image"})
 
-	paths := []string{
-		"/path50",
-		"/api/users",
-		"/files/test.jpg",
-		"/nonexistent",
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		router.Match(paths[i%len(paths)])
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(ctx)
+	}()
+
+	var addr net.Addr
+	deadline := time.Now().Add(2 * time.Second)
+	for addr == nil && time.Now().Before(deadline) {
+		addr = server.ListenerAddr()
+		time.Sleep(10 * time.Millisecond)
 	}
-}
 
-// Update for benchmark tests that create server instances
-func BenchmarkParseRequest(b *testing.B) {
-	server := NewHTTPServer("127.0.0.1:0", b.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if addr == nil {
+		t.Fatal("ListenerAddr() returned nil after server start")
+	}
 
-	request := "GET /test/path HTTP/1.1\r\n" +
-		"Host: localhost:8080\r\n" +
-		"User-Agent: BenchmarkClient/1.0\r\n" +
-		"Accept: text/html,application/json\r\n" +
-		"Accept-Encoding: gzip, deflate\r\n" +
-		"Connection: keep-alive\r\n" +
-		"\r\n"
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("ListenerAddr() = %T, want *net.TCPAddr", addr)
+	}
+	if tcpAddr.Port == 0 {
+		t.Error("Expected a non-zero port")
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		reader := bufio.NewReader(strings.NewReader(request))
-		_, err := server.parseRequest(reader)
+	cancel()
+	select {
+	case err := <-serverErr:
 		if err != nil {
-			b.Fatal(err)
+			t.Errorf("ListenAndServe error: %v", err)
 		}
+	case <-time.After(3 * time.Second):
+		t.Error("Server did not shut down in time")
 	}
 }
 
-func BenchmarkWriteResponse(b *testing.B) {
-	server := NewHTTPServer("127.0.0.1:0", b.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+// TestIdleConnectionReaper tests that an idle kept-alive connection is closed by the reaper
+func TestIdleConnectionReaper(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.IdleTimeout = 100 * time.Millisecond
 
-	response := &Response{
-		Protocol:   "HTTP/1.1",
-		StatusCode: 200,
-		StatusText: "OK",
-		Headers: map[string]string{
-			"Content-Type":   "text/html; charset=utf-8",
-			"Content-Length": "1000",
-			"Cache-Control":  "public, max-age=3600",
-			"Server":         "tiny-http/0.1",
-		},
-		Body: bytes.Repeat([]byte("a"), 1000),
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		writer := bufio.NewWriter(io.Discard)
-		err := server.writeResponse(writer, response)
-		if err != nil {
-			b.Fatal(err)
-		}
+	go server.ListenAndServe(ctx)
+
+	var addr net.Addr
+	deadline := time.Now().Add(2 * time.Second)
+	for addr == nil && time.Now().Before(deadline) {
+		addr = server.ListenerAddr()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("ListenerAddr() returned nil after server start")
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The keep-alive timeout is far longer than the idle timeout, so only the
+	// reaper can close the connection after this request
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	if _, _, _, err := readTestResponse(reader); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected EOF from reaped connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connection took %v to be reaped", elapsed)
+	}
+
+	if reaped := server.Stats().ConnectionsReaped; reaped != 1 {
+		t.Errorf("ConnectionsReaped = %d, want 1", reaped)
+	}
+}
+
+// TestServerListenerAddrConcurrentStart reads the address while the server starts
+// and stops; run with -race to catch unsynchronized access to the listener
+func TestServerListenerAddrConcurrentStart(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = server.ListenerAddr()
+				}
+			}
+		}()
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			t.Errorf("ListenAndServe error: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Server did not shut down in time")
+	}
+
+	close(stop)
+	readers.Wait()
+}
+
+// TestServerShutdownBeforeListen tests that a server shut down before starting doesn't serve
+func TestServerShutdownBeforeListen(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+
+	if err := server.ListenAndServe(context.Background()); err != ErrServerClosed {
+		t.Errorf("ListenAndServe error = %v, want %v", err, ErrServerClosed)
+	}
+
+	if addr := server.ListenerAddr(); addr != nil {
+		t.Errorf("ListenerAddr() = %v, want nil", addr)
+	}
+}
+
+// TestServerShutdownMethod tests programmatic shutdown without cancelling the context
+func TestServerShutdownMethod(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "test.txt"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(context.Background())
+	}()
+
+	var addr net.Addr
+	deadline := time.Now().Add(2 * time.Second)
+	for addr == nil && time.Now().Before(deadline) {
+		addr = server.ListenerAddr()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("Server did not start")
+	}
+
+	// Complete a request so there's been real traffic before shutting down
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /test.txt HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown error: %v", err)
+	}
+
+	// A second call must be harmless
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown error: %v", err)
+	}
+
+	select {
+	case err := <-serverErr:
+		if err != ErrServerClosed {
+			t.Errorf("ListenAndServe error = %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("ListenAndServe did not return after Shutdown")
+	}
+
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Error("Expected new connections to be refused after Shutdown")
+	}
+}
+
+// Benchmark tests
+func BenchmarkHTTPRouterMatch(b *testing.B) {
+	router := NewHTTPRouter()
+
+	// Add various routes
+	for i := 0; i < 100; i++ {
+		router.AddRoute(fmt.Sprintf("/path%d", i), &testHandler{response: "test"})
+	}
+	router.AddRoute(`^/api/.*$`, &testHandler{response: "api"})
+	router.AddRoute(`^/files/.*\.(jpg|png)$`, &testHandler{response: "image"})
+
+	paths := []string{
+		"/path50",
+		"/api/users",
+		"/files/test.jpg",
+		"/nonexistent",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.Match(paths[i%len(paths)])
+	}
+}
+
+// Update for benchmark tests that create server instances
+func BenchmarkParseRequest(b *testing.B) {
+	server := NewHTTPServer("127.0.0.1:0", b.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	request := "GET /test/path HTTP/1.1\r\n" +
+		"Host: localhost:8080\r\n" +
+		"User-Agent: BenchmarkClient/1.0\r\n" +
+		"Accept: text/html,application/json\r\n" +
+		"Accept-Encoding: gzip, deflate\r\n" +
+		"Connection: keep-alive\r\n" +
+		"\r\n"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := bufio.NewReader(strings.NewReader(request))
+		_, err := server.parseRequest(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteResponse(b *testing.B) {
+	server := NewHTTPServer("127.0.0.1:0", b.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	response := &Response{
+		Protocol:   "HTTP/1.1",
+		StatusCode: 200,
+		StatusText: "OK",
+		Headers: map[string]string{
+			"Content-Type":   "text/html; charset=utf-8",
+			"Content-Length": "1000",
+			"Cache-Control":  "public, max-age=3600",
+			"Server":         "tiny-http/0.1",
+		},
+		Body: bytes.Repeat([]byte("a"), 1000),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer := bufio.NewWriter(io.Discard)
+		err := server.writeResponse(writer, response)
+		if err != nil {
+			b.Fatal(err)
+		}
 	}
 }
 
@@ -500,6 +1112,82 @@ func TestHTTPRouterExactVsRegexPrecedence(t *testing.T) {
 	}
 }
 
+// TestHTTPRouterFallback tests that the fallback only handles unmatched paths
+func TestHTTPRouterFallback(t *testing.T) {
+	router := NewHTTPRouter()
+
+	if _, found := router.Match("/anything"); found {
+		t.Fatal("Expected no match without a fallback")
+	}
+
+	router.AddRoute("/api/status", &testHandler{response: "exact"})
+	router.AddRoute(`^/api/users/\d+$`, &testHandler{response: "regex"})
+	router.SetFallback(&testHandler{response: "fallback"})
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/status", "exact"},
+		{"/api/users/42", "regex"},
+		{"/api/users/abc", "fallback"},
+		{"/index.html", "fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			h, found := router.Match(tt.path)
+			if !found {
+				t.Fatalf("Expected a handler for %s", tt.path)
+			}
+			if resp, _ := h(&Request{}); string(resp.Body) != tt.expected {
+				t.Errorf("Handler for %s = %s, want %s", tt.path, string(resp.Body), tt.expected)
+			}
+		})
+	}
+}
+
+// TestServerAPIRouteWithFileFallback tests API routes alongside the default file handler
+func TestServerAPIRouteWithFileFallback(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "page.html"), []byte("<html>page</html>"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/api/status", &testHandler{response: "api ok"})
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/api/status", 200, "api ok"},
+		{"/page.html", 200, "<html>page</html>"},
+		{"/missing.html", 404, "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     tt.path,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp := server.handleRequest(req)
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if string(resp.Body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", string(resp.Body), tt.expectedBody)
+			}
+		})
+	}
+}
+
 // TestHTTPRouterRemoveRoute tests route removal
 func TestHTTPRouterRemoveRoute(t *testing.T) {
 	router := NewHTTPRouter()
@@ -521,6 +1209,49 @@ func TestHTTPRouterRemoveRoute(t *testing.T) {
 	}
 }
 
+// TestHTTPRouterQueryString tests that routes match the request path without
+// its query, and that an encoded "?" stays part of the path
+func TestHTTPRouterQueryString(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/api", &testHandler{response: "api"})
+	server.Router.AddRoute(`^/users/\d+$`, &testHandler{response: "user"})
+
+	tests := []struct {
+		target         string
+		expectedStatus string
+		expectedBody   string
+	}{
+		{"/api?foo=bar", "HTTP/1.1 200", "api"},
+		{"/api?", "HTTP/1.1 200", "api"},
+		{"/users/7?tab=posts", "HTTP/1.1 200", "user"},
+		{"/api%3Fx", "HTTP/1.1 404", ""},
+		{"/users/7%3Ftab=posts", "HTTP/1.1 404", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			out := server.ServeRaw([]byte("GET " + tt.target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+			status, _, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if !strings.HasPrefix(status, tt.expectedStatus) {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("Expected body %q, got %q", tt.expectedBody, string(body))
+			}
+		})
+	}
+
+	router := NewHTTPRouter()
+	router.AddRoute("/api", &testHandler{response: "api"})
+	if _, found := router.Match("/api?x"); found {
+		t.Error("Expected a decoded \"?\" not to be stripped by the router")
+	}
+}
+
 // TestParseRequestLargeHeaders tests handling of large headers
 func TestParseRequestLargeHeaders(t *testing.T) {
 	server := &HTTPServer{
@@ -529,7 +1260,7 @@ func TestParseRequestLargeHeaders(t *testing.T) {
 
 	// Create a request with very large header value
 	largeValue := strings.Repeat("a", 8192)
-	input := fmt.Sprintf("GET /test HTTP/1.1\r\nX-Large-Header: %s\r\n\r\n", largeValue)
+	input := fmt.Sprintf("GET /test HTTP/1.1\r\nHost: localhost\r\nX-Large-Header: %s\r\n\r\n", largeValue)
 
 	reader := bufio.NewReader(strings.NewReader(input))
 	req, err := server.parseRequest(reader)
@@ -541,46 +1272,208 @@ func TestParseRequestLargeHeaders(t *testing.T) {
 	}
 }
 
-// TestParseRequestWithBody tests request parsing with various body sizes
-func TestParseRequestWithBody(t *testing.T) {
-	server := &HTTPServer{
-		Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+// TestHeaderLineTooLong tests that an unterminated oversized header line is rejected
+func TestHeaderLineTooLong(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.MaxHeaderLineBytes = 1024
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	// Never send a line ending, the server must give up on its own
+	go func() {
+		fmt.Fprintf(clientConn, "GET / HTTP/1.1\r\nX-Endless: %s", strings.Repeat("a", 4096))
+	}()
+
+	clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	statusLine, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
 	}
 
+	if !strings.Contains(statusLine, "400 Bad Request") {
+		t.Errorf("Expected 400 Bad Request, got: %s", statusLine)
+	}
+}
+
+// TestTooLargeResponseBodies tests that 413 and 431 bodies carry the message and the exceeded limit
+func TestTooLargeResponseBodies(t *testing.T) {
 	tests := []struct {
-		name        string
-		body        string
-		contentType string
+		name           string
+		configure      func(s *HTTPServer)
+		request        string
+		expectedStatus string
+		expectedBody   string
 	}{
 		{
-			name:        "small JSON body",
-			body:        `{"key": "value"}`,
-			contentType: "application/json",
+			name:           "default body limit",
+			configure:      func(s *HTTPServer) {},
+			request:        "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1048577\r\n\r\n",
+			expectedStatus: "HTTP/1.1 413 Request Entity Too Large",
+			expectedBody:   "413 Request Entity Too Large: max body size 1048576 bytes",
 		},
 		{
-			name:        "form data",
-			body:        "field1=value1&field2=value2",
-			contentType: "application/x-www-form-urlencoded",
+			name: "custom body message",
+			configure: func(s *HTTPServer) {
+				s.MaxRequestBodyBytes = 64
+				s.BodyTooLargeMessage = "Uploads must be small"
+			},
+			request:        "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 65\r\n\r\n",
+			expectedStatus: "HTTP/1.1 413 Request Entity Too Large",
+			expectedBody:   "Uploads must be small: max body size 64 bytes",
 		},
 		{
-			name:        "large body",
-			body:        strings.Repeat("test data ", 1000),
-			contentType: "text/plain",
+			name: "custom header message",
+			configure: func(s *HTTPServer) {
+				s.TextprotoHeaders = true
+				s.MaxHeaderBytes = 128
+				s.HeaderTooLargeMessage = "Trim your cookies"
+			},
+			request:        "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: " + strings.Repeat("c", 64) + "\r\nX-Extra: " + strings.Repeat("x", 64) + "\r\n\r\n",
+			expectedStatus: "HTTP/1.1 431 Request Header Fields Too Large",
+			expectedBody:   "Trim your cookies: max header size 128 bytes",
 		},
 		{
-			name:        "binary data",
-			body:        string([]byte{0, 1, 2, 3, 255, 254, 253}),
-			contentType: "application/octet-stream",
+			name: "header line limit",
+			configure: func(s *HTTPServer) {
+				s.MaxHeaderLineBytes = 128
+				s.HeaderTooLargeMessage = "Trim your cookies"
+			},
+			request:        "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: " + strings.Repeat("c", 256) + "\r\n\r\n",
+			expectedStatus: "HTTP/1.1 400 Bad Request",
+			expectedBody:   "400 Bad Request: max header line 128 bytes",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			input := fmt.Sprintf("POST /test HTTP/1.1\r\n"+
-				"Content-Type: %s\r\n"+
-				"Content-Length: %d\r\n"+
-				"\r\n%s",
-				tt.contentType, len(tt.body), tt.body)
+			server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			tt.configure(server)
+
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", body, tt.expectedBody)
+			}
+			if headers["Connection"] != "close" {
+				t.Errorf("Expected Connection: close, got %q", headers["Connection"])
+			}
+		})
+	}
+}
+
+// TestHeaderReadTimeout tests that a client dribbling the request head is dropped
+func TestHeaderReadTimeout(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.HeaderReadTimeout = 200 * time.Millisecond
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server.handleConnection(serverConn)
+		close(done)
+	}()
+
+	// Send a single byte of the request line, then stall
+	start := time.Now()
+	if _, err := clientConn.Write([]byte("G")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connection was not dropped after the header timeout")
+	}
+
+	if elapsed := time.Since(start); elapsed < server.HeaderReadTimeout {
+		t.Errorf("Connection dropped after %v, before the %v header timeout", elapsed, server.HeaderReadTimeout)
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF on dropped connection, got %v", err)
+	}
+}
+
+// TestHeaderReadTimeoutExcludesBody tests that a slow body isn't cut off by the header timeout
+func TestHeaderReadTimeoutExcludesBody(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.HeaderReadTimeout = 100 * time.Millisecond
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintf(clientConn, "GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\n")
+
+	// Deliver the body well after the header timeout would have fired
+	time.Sleep(300 * time.Millisecond)
+	fmt.Fprintf(clientConn, "body")
+
+	status, _, _, err := readTestResponse(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 ") {
+		t.Errorf("Unexpected status line: %q", status)
+	}
+}
+
+// TestParseRequestWithBody tests request parsing with various body sizes
+func TestParseRequestWithBody(t *testing.T) {
+	server := &HTTPServer{
+		Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+	}{
+		{
+			name:        "small JSON body",
+			body:        `{"key": "value"}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "form data",
+			body:        "field1=value1&field2=value2",
+			contentType: "application/x-www-form-urlencoded",
+		},
+		{
+			name:        "large body",
+			body:        strings.Repeat("test data ", 1000),
+			contentType: "text/plain",
+		},
+		{
+			name:        "binary data",
+			body:        string([]byte{0, 1, 2, 3, 255, 254, 253}),
+			contentType: "application/octet-stream",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := fmt.Sprintf("POST /test HTTP/1.1\r\n"+
+				"Host: localhost\r\n"+
+				"Content-Type: %s\r\n"+
+				"Content-Length: %d\r\n"+
+				"\r\n%s",
+				tt.contentType, len(tt.body), tt.body)
 
 			reader := bufio.NewReader(strings.NewReader(input))
 			req, err := server.parseRequest(reader)
@@ -748,7 +1641,7 @@ func TestErrorResponseGeneration(t *testing.T) {
 		expectedStatus int
 		expectedAllow  string
 	}{
-		{"method not allowed", "POST", "/test.txt", 405, "GET, HEAD"},
+		{"method not allowed", "POST", "/test.txt", 405, "GET, OPTIONS, HEAD"},
 		{"not found", "GET", "/nonexistent.txt", 404, ""},
 		{"forbidden directory traversal", "GET", "/../etc/passwd", 404, ""},
 		{"forbidden absolute path", "GET", "/etc/passwd", 404, ""}, // Should be treated as relative to document root
@@ -841,89 +1734,1735 @@ func TestConcurrentConnections(t *testing.T) {
 	}
 }
 
-// TestMIMETypeDetection tests MIME type detection for various file extensions
-func TestMIMETypeDetection(t *testing.T) {
-	tempDir := t.TempDir()
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
+// TestDecodeRequestBodies tests that compressed request bodies are decoded
+// within the body limit
+func TestDecodeRequestBodies(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.MaxRequestBodyBytes = 4096
+	server.DecodeRequestBodies = true
+	server.Router.(*HTTPRouter).AddMethodRoute("POST", "/echo", HandlerFunc(func(req *Request) (*Response, error) {
+		resp := HTTPBaseResponse(200, "OK")
+		resp.Body = req.Body
+		resp.Headers["Content-Length"] = strconv.Itoa(len(req.Body))
+		resp.Headers["X-Request-Encoding"] = req.Headers["Content-Encoding"]
+		resp.Headers["X-Request-Length"] = req.Headers["Content-Length"]
+		return resp, nil
+	}))
+
+	compress := func(encoding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		default:
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	post := func(encoding string, body []byte) (string, map[string]string, []byte) {
+		raw := fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n", encoding, len(body))
+		status, headers, respBody, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw(append([]byte(raw), body...)))))
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return strings.Fields(status)[1], headers, respBody
+	}
 
-	testFiles := map[string]string{
-		"test.html": "text/html; charset=utf-8",
-		"test.css":  "text/css; charset=utf-8",
-		"test.js":   "application/javascript; charset=utf-8",
-		"test.json": "application/json; charset=utf-8",
-		"test.xml":  "application/xml; charset=utf-8",
-		"test.txt":  "text/plain; charset=utf-8",
-		"test.png":  "image/png",
-		"test.jpg":  "image/jpeg",
-		"test.gif":  "image/gif",
-		"test.pdf":  "application/pdf",
-		"noext":     "text/plain; charset=utf-8", // Default for unknown extensions
+	payload := []byte(`{"message": "` + strings.Repeat("compressed ", 50) + `"}`)
+	for _, encoding := range []string{"gzip", "deflate", "raw deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			header := strings.Fields(encoding)[len(strings.Fields(encoding))-1]
+			code, headers, body := post(header, compress(encoding, payload))
+			if code != "200" {
+				t.Fatalf("Status = %s, want 200", code)
+			}
+			if !bytes.Equal(body, payload) {
+				t.Errorf("Handler got %q, want %q", body, payload)
+			}
+			if headers["X-Request-Encoding"] != "" || headers["X-Request-Length"] != strconv.Itoa(len(payload)) {
+				t.Errorf("Handler saw Content-Encoding %q and Content-Length %q, want none and %d",
+					headers["X-Request-Encoding"], headers["X-Request-Length"], len(payload))
+			}
+		})
 	}
 
-	// Create test files
-	for filename := range testFiles {
-		filePath := filepath.Join(tempDir, filename)
-		if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
-			t.Fatalf("Failed to create file %s: %v", filename, err)
-		}
+	// A few hundred compressed bytes that expand far past the limit
+	bomb := compress("gzip", make([]byte, 1024*1024))
+	if len(bomb) > 4096 {
+		t.Fatalf("Bomb is %d bytes compressed, want it under the limit", len(bomb))
+	}
+	if code, headers, _ := post("gzip", bomb); code != "413" || headers["Connection"] != "close" {
+		t.Errorf("Decompression bomb got %s with Connection %q, want 413 and close", code, headers["Connection"])
 	}
 
-	for filename, expectedMIME := range testFiles {
-		t.Run(filename, func(t *testing.T) {
-			req := &Request{
-				Method:   "GET",
-				Path:     "/" + filename,
-				Protocol: "HTTP/1.1",
-				Headers:  make(map[string]string),
+	if code, _, _ := post("gzip", []byte("not gzip at all")); code != "400" {
+		t.Errorf("Corrupt gzip body = %s, want 400", code)
+	}
+
+	// Unknown encodings, and all encodings with decoding off, reach the handler as sent
+	if code, headers, body := post("br", []byte("opaque")); code != "200" || string(body) != "opaque" || headers["X-Request-Encoding"] != "br" {
+		t.Errorf("br body = %s %q with encoding %q, want it passed through", code, body, headers["X-Request-Encoding"])
+	}
+	server.DecodeRequestBodies = false
+	gzipped := compress("gzip", payload)
+	if code, _, body := post("gzip", gzipped); code != "200" || !bytes.Equal(body, gzipped) {
+		t.Errorf("With decoding off the handler got %s %q, want the compressed body", code, body)
+	}
+}
+
+// panickingReader panics when a streamed body is read
+type panickingReader struct{}
+
+func (panickingReader) Read(p []byte) (int, error) { panic("broken body") }
+func (panickingReader) Close() error               { return nil }
+
+func TestConnectionPanicRecovered(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), logger)
+
+	// The panic happens while writing the response, outside any middleware
+	server.Router.AddRoute("/panic", HandlerFunc(func(req *Request) (*Response, error) {
+		return StreamResponse(200, "text/plain", 10, panickingReader{}), nil
+	}))
+	server.Router.AddRoute("/ok", HandlerFunc(func(req *Request) (*Response, error) {
+		return HTTPBaseResponse(200, "OK"), nil
+	}))
+
+	server.ServeRaw([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	if !strings.Contains(logs.String(), "panic serving connection") || !strings.Contains(logs.String(), "broken body") {
+		t.Errorf("Expected the panic to be logged, got: %s", logs.String())
+	}
+
+	// The server keeps serving other connections
+	out := server.ServeRaw([]byte("GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("Expected 200 OK, got %q", status)
+	}
+}
+
+// TestHostHeaderRequired tests that HTTP/1.1 requests need exactly one Host header
+func TestHostHeaderRequired(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/", &testHandler{response: "ok"})
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+	}{
+		{"present Host", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "200"},
+		{"lowercase Host", "GET / HTTP/1.1\r\nhost: localhost\r\n\r\n", "200"},
+		{"empty Host", "GET / HTTP/1.1\r\nHost:\r\n\r\n", "200"},
+		{"missing Host", "GET / HTTP/1.1\r\n\r\n", "400"},
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n", "400"},
+		{"duplicate Host in another case", "GET / HTTP/1.1\r\nHost: a.example\r\nHOST: a.example\r\n\r\n", "400"},
+		{"HTTP/1.0 without Host", "GET / HTTP/1.0\r\n\r\n", "200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if code := strings.Fields(status)[1]; code != tt.expectedStatus {
+				t.Errorf("Status = %q, want %s", status, tt.expectedStatus)
 			}
+			if tt.expectedStatus == "400" && headers["Connection"] != "close" {
+				t.Errorf("Expected the connection to close after a 400, got Connection %q", headers["Connection"])
+			}
+		})
+	}
+}
 
-			resp := server.handleRequest(req)
+// TestMethodOverride tests that an overridden POST is routed by its new method
+func TestMethodOverride(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.PreRoutingMiddlewares = []Middleware{MethodOverrideMiddleware()}
+
+	var invoked []string
+	for _, method := range []string{"POST", "DELETE", "TRACE"} {
+		server.Router.(*HTTPRouter).AddMethodRoute(method, "/items", HandlerFunc(func(req *Request) (*Response, error) {
+			invoked = append(invoked, method)
+			return HTTPBaseResponse(200, "OK"), nil
+		}))
+	}
 
-			if resp.StatusCode != 200 {
-				t.Fatalf("Expected 200 OK, got %d", resp.StatusCode)
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+		expectedMethod string
+	}{
+		{"override to DELETE", "POST /items HTTP/1.1\r\nHost: localhost\r\nX-HTTP-Method-Override: delete\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 200 OK", "DELETE"},
+		{"method not allowed for override", "POST /items HTTP/1.1\r\nHost: localhost\r\nX-HTTP-Method-Override: TRACE\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 200 OK", "POST"},
+		{"plain POST", "POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 200 OK", "POST"},
+		{"only POST is overridden", "GET /items HTTP/1.1\r\nHost: localhost\r\nX-HTTP-Method-Override: DELETE\r\n\r\n", "HTTP/1.1 404 Not Found", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoked = nil
+			status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(tt.request)))))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if status != tt.expectedStatus {
+				t.Errorf("Status = %q, want %q", status, tt.expectedStatus)
 			}
 
-			if resp.Headers["Content-Type"] != expectedMIME {
-				t.Errorf("MIME type = %q, want %q", resp.Headers["Content-Type"], expectedMIME)
+			var expected []string
+			if tt.expectedMethod != "" {
+				expected = []string{tt.expectedMethod}
+			}
+			if !reflect.DeepEqual(invoked, expected) {
+				t.Errorf("Invoked handlers = %v, want %v", invoked, expected)
 			}
 		})
 	}
 }
 
-// TestQueryStringHandling tests handling of query strings in URLs
-func TestQueryStringHandling(t *testing.T) {
+// recordingRouter is a minimal Router that serves every path and records them
+type recordingRouter struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (r *recordingRouter) Match(path string) (HandlerFunc, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths = append(r.paths, path)
+
+	if path == "/missing" {
+		return nil, false
+	}
+	return func(req *Request) (*Response, error) {
+		return HTTPBaseResponse(200, "OK"), nil
+	}, true
+}
+
+func (r *recordingRouter) AddRoute(pattern string, handler Handler) {}
+
+func TestCustomRouter(t *testing.T) {
+	router := &recordingRouter{}
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router = router
+
+	tests := []struct {
+		request        string
+		expectedStatus string
+		expectedAllow  string
+	}{
+		{"GET /a%20b?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 OK", ""},
+		{"GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 404 Not Found", ""},
+		{"OPTIONS /options HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 OK", "GET, OPTIONS, HEAD"},
+		{"DELETE /delete HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 405 Method Not Allowed", "GET, OPTIONS, HEAD"},
+	}
+
+	for _, tt := range tests {
+		out := server.ServeRaw([]byte(tt.request))
+		status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+		if err != nil {
+			t.Fatalf("Failed to read response to %q: %v", tt.request, err)
+		}
+		if status != tt.expectedStatus {
+			t.Errorf("%q: expected %q, got %q", tt.request, tt.expectedStatus, status)
+		}
+		if headers["Allow"] != tt.expectedAllow {
+			t.Errorf("%q: Allow = %q, want %q", tt.request, headers["Allow"], tt.expectedAllow)
+		}
+	}
+
+	// The router sees decoded paths without the query string
+	expected := []string{"/a b", "/missing", "/options", "/delete"}
+	if !reflect.DeepEqual(router.paths, expected) {
+		t.Errorf("Matched paths = %q, want %q", router.paths, expected)
+	}
+}
+
+// TestServeRaw tests running requests through the pipeline without a socket
+func TestServeRaw(t *testing.T) {
 	tempDir := t.TempDir()
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
 
-	// Create test file
-	testFile := filepath.Join(tempDir, "query-test.html")
-	if err := os.WriteFile(testFile, []byte("<html>test</html>"), 0644); err != nil {
+	testContent := "served without a socket"
+	if err := os.WriteFile(filepath.Join(tempDir, "raw.txt"), []byte(testContent), 0644); err != nil {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
-	testPaths := []string{
-		"/query-test.html",
-		"/query-test.html?param=value",
-		"/query-test.html?multiple=params&test=123",
-		"/query-test.html?empty=&null",
+	out := server.ServeRaw([]byte("GET /raw.txt HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /missing.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reader := bufio.NewReader(bytes.NewReader(out))
+
+	status, headers, body, err := readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read first response: %v", err)
+	}
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("Expected 200 OK, got %q", status)
+	}
+	if headers["Content-Type"] != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type: %q", headers["Content-Type"])
+	}
+	if string(body) != testContent {
+		t.Errorf("Expected body %q, got %q", testContent, body)
 	}
 
-	for _, path := range testPaths {
-		t.Run(path, func(t *testing.T) {
-			req := &Request{
-				Method:   "GET",
-				Path:     path,
-				Protocol: "HTTP/1.1",
-				Headers:  make(map[string]string),
+	// Pipelined requests are answered in order on the same connection
+	status, _, _, err = readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	if status != "HTTP/1.1 404 Not Found" {
+		t.Errorf("Expected 404 Not Found, got %q", status)
+	}
+
+	if rest, _ := io.ReadAll(reader); len(rest) != 0 {
+		t.Errorf("Unexpected trailing output: %q", rest)
+	}
+}
+
+// TestHTTP10BodyUntilClose tests that an HTTP/1.0 request body without a
+// Content-Length is read until the client closes its side
+func TestHTTP10BodyUntilClose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), logger)
+	server.MaxRequestBodyBytes = 16
+	server.Router.(*HTTPRouter).AddMethodRoute("POST", "/echo", HandlerFunc(func(req *Request) (*Response, error) {
+		resp := HTTPBaseResponse(200, "OK")
+		resp.Body = req.Body
+		resp.Headers["Content-Length"] = strconv.Itoa(len(req.Body))
+		return resp, nil
+	}))
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+		expectedBody   string
+		expectedClose  bool
+	}{
+		{"body read until close", "POST /echo HTTP/1.0\r\n\r\nhello, world", "HTTP/1.1 200 OK", "hello, world", true},
+		{"empty body", "POST /echo HTTP/1.0\r\n\r\n", "HTTP/1.1 200 OK", "", true},
+		{"content-length still honored", "POST /echo HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello", "HTTP/1.1 200 OK", "hello", false},
+		{"over the body limit", "POST /echo HTTP/1.0\r\n\r\n" + strings.Repeat("x", 17), "HTTP/1.1 413 Request Entity Too Large", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if status != tt.expectedStatus {
+				t.Errorf("Expected %q, got %q", tt.expectedStatus, status)
 			}
+			if (headers["Connection"] == "close") != tt.expectedClose {
+				t.Errorf("Connection = %q, want close: %v", headers["Connection"], tt.expectedClose)
+			}
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", body, tt.expectedBody)
+			}
+		})
+	}
+}
 
-			resp := server.handleRequest(req)
+// TestAcceptRangesOnlyForFiles tests that only served files advertise byte ranges
+func TestAcceptRangesOnlyForFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
 
-			// All should return 200 OK since query strings should be ignored for file serving
-			if resp.StatusCode != 200 {
-				t.Errorf("Expected 200 OK for %s, got %d", path, resp.StatusCode)
+	if err := os.WriteFile(filepath.Join(tempDir, "ranged.txt"), []byte("ranged"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		path          string
+		expectedRange string
+	}{
+		{"/ranged.txt", "bytes"},
+		{"/missing.txt", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			out := server.ServeRaw([]byte("GET " + tt.path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			_, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if headers["Accept-Ranges"] != tt.expectedRange {
+				t.Errorf("Accept-Ranges = %q, want %q", headers["Accept-Ranges"], tt.expectedRange)
+			}
+		})
+	}
+}
+
+// gatedReader returns first, then blocks until release is closed before returning rest
+type gatedReader struct {
+	first, rest []byte
+	release     chan struct{}
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	if len(r.first) > 0 {
+		n := copy(p, r.first)
+		r.first = r.first[n:]
+		return n, nil
+	}
+	<-r.release
+	if len(r.rest) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// TestStreamFlushBytes tests that streamed data reaches the client before the source finishes
+func TestStreamFlushBytes(t *testing.T) {
+	first := bytes.Repeat([]byte("a"), 600)
+	rest := bytes.Repeat([]byte("b"), 600)
+	source := &gatedReader{first: first, rest: rest, release: make(chan struct{})}
+	defer func() {
+		select {
+		case <-source.release:
+		default:
+			close(source.release)
+		}
+	}()
+
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.StreamFlushBytes = 512
+	server.Router.AddRoute("/progress", HandlerFunc(func(req *Request) (*Response, error) {
+		return StreamResponse(200, "application/octet-stream", int64(len(first)+len(rest)), io.NopCloser(source)), nil
+	}))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+
+	go fmt.Fprint(clientConn, "GET /progress HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	reader := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read headers: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// The first chunk must arrive while the source is still blocked
+	got := make([]byte, len(first))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("First chunk didn't arrive before the source finished: %v", err)
+	}
+	if !bytes.Equal(got, first) {
+		t.Error("First chunk doesn't match")
+	}
+
+	close(source.release)
+	got = make([]byte, len(rest))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("Failed to read the rest: %v", err)
+	}
+	if !bytes.Equal(got, rest) {
+		t.Error("Remaining data doesn't match")
+	}
+}
+
+// TestBodylessStatusesOnTheWire tests that 204 and 304 end at the headers even if a handler set a body
+func TestBodylessStatusesOnTheWire(t *testing.T) {
+	server := &HTTPServer{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	for _, status := range []int{204, 304} {
+		t.Run(fmt.Sprint(status), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := bufio.NewWriter(&buf)
+			resp := &Response{
+				StatusCode: status,
+				StatusText: "Test",
+				Protocol:   "HTTP/1.1",
+				Headers:    map[string]string{"Content-Length": "4", "X-Test": "yes"},
+				Body:       []byte("body"),
+			}
+
+			if err := server.writeResponse(writer, resp); err != nil {
+				t.Fatalf("writeResponse failed: %v", err)
+			}
+
+			out := buf.String()
+			if !strings.HasSuffix(out, "\r\n\r\n") {
+				t.Errorf("Expected the response to end after the headers, got %q", out)
+			}
+			if strings.Contains(out, "Content-Length") {
+				t.Errorf("Expected no Content-Length, got %q", out)
+			}
+			if !strings.Contains(out, "X-Test: yes") {
+				t.Errorf("Expected other headers to be kept, got %q", out)
+			}
+		})
+	}
+}
+
+// TestKeepAliveLimits tests that the connection closes once the request budget is spent
+func TestKeepAliveLimits(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "test.txt"), []byte("keep-alive"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.KeepAliveTimeout = 5 * time.Second
+	server.MaxKeepAliveRequests = 2
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(clientConn)
+
+	expected := []struct {
+		connection string
+		keepAlive  string
+	}{
+		{"keep-alive", "timeout=5, max=2"},
+		{"keep-alive", "timeout=5, max=1"},
+		{"close", ""},
+	}
+
+	for i, want := range expected {
+		if _, err := fmt.Fprintf(clientConn, "GET /test.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatalf("request %d: write error: %v", i+1, err)
+		}
+
+		status, headers, _, err := readTestResponse(reader)
+		if err != nil {
+			t.Fatalf("request %d: read error: %v", i+1, err)
+		}
+		if !strings.Contains(status, "200 OK") {
+			t.Errorf("request %d: status = %q, want 200 OK", i+1, status)
+		}
+		if headers["Connection"] != want.connection {
+			t.Errorf("request %d: Connection = %q, want %q", i+1, headers["Connection"], want.connection)
+		}
+		if headers["Keep-Alive"] != want.keepAlive {
+			t.Errorf("request %d: Keep-Alive = %q, want %q", i+1, headers["Keep-Alive"], want.keepAlive)
+		}
+	}
+
+	// The server must have closed its end after the last allowed request
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected EOF after final response, got %v", err)
+	}
+}
+
+// TestKeepAliveClientClose tests that Connection: close from the client is echoed
+func TestKeepAliveClientClose(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintf(clientConn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	_, headers, _, err := readTestResponse(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if headers["Connection"] != "close" {
+		t.Errorf("Connection = %q, want close", headers["Connection"])
+	}
+	if _, exists := headers["Keep-Alive"]; exists {
+		t.Error("Did not expect Keep-Alive header on a closing connection")
+	}
+}
+
+// TestPipelinedRequests tests that two requests arriving in a single write are
+// both answered, in order, on the same connection
+func TestPipelinedRequests(t *testing.T) {
+	tempDir := t.TempDir()
+	for name, content := range map[string]string{"first.txt": "first", "second.txt": "second"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.handleConnection(conn)
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	requests := "GET /first.txt HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /second.txt HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	if _, err := clientConn.Write([]byte(requests)); err != nil {
+		t.Fatalf("Failed to write requests: %v", err)
+	}
+
+	reader := bufio.NewReader(clientConn)
+	for i, expected := range []string{"first", "second"} {
+		status, _, body, err := readTestResponse(reader)
+		if err != nil {
+			t.Fatalf("response %d: read error: %v", i+1, err)
+		}
+		if status != "HTTP/1.1 200 OK" {
+			t.Errorf("response %d: status = %q, want 200 OK", i+1, status)
+		}
+		if string(body) != expected {
+			t.Errorf("response %d: body = %q, want %q", i+1, body, expected)
+		}
+	}
+
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected EOF after the second response, got %v", err)
+	}
+}
+
+// TestRequestTimeout tests that a slow handler followed by a stalled client
+// runs into the request cap and gets the connection closed
+func TestRequestTimeout(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.RequestTimeout = 300 * time.Millisecond
+	server.Router.AddRoute("/slow", HandlerFunc(func(req *Request) (*Response, error) {
+		time.Sleep(200 * time.Millisecond)
+		return HTTPBaseResponse(200, "OK"), nil
+	}))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server.handleConnection(serverConn)
+		close(done)
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := fmt.Fprintf(clientConn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	// Neither the handler nor the write exceeds the cap alone, but the
+	// client reads nothing so the write stalls until the cap closes it
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the connection to be closed after RequestTimeout")
+	}
+
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF from the closed connection, got %v", err)
+	}
+}
+
+// TestRequestTimeoutPerRequest tests that each kept-alive request gets the full cap
+func TestRequestTimeoutPerRequest(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.RequestTimeout = 300 * time.Millisecond
+	server.Router.AddRoute("/slow", HandlerFunc(func(req *Request) (*Response, error) {
+		time.Sleep(200 * time.Millisecond)
+		return HTTPBaseResponse(200, "OK"), nil
+	}))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(clientConn)
+
+	// Together the requests take longer than the cap
+	for i := 0; i < 2; i++ {
+		if _, err := fmt.Fprintf(clientConn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatalf("request %d: write error: %v", i+1, err)
+		}
+		status, _, _, err := readTestResponse(reader)
+		if err != nil {
+			t.Fatalf("request %d: read error: %v", i+1, err)
+		}
+		if status != "HTTP/1.1 200 OK" {
+			t.Errorf("request %d: status = %q, want 200 OK", i+1, status)
+		}
+	}
+}
+
+// TestServerStats tests that traffic counters cover a full request/response
+func TestServerStats(t *testing.T) {
+	tempDir := t.TempDir()
+	content := strings.Repeat("stats ", 100)
+	if err := os.WriteFile(filepath.Join(tempDir, "stats.txt"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	before := server.Stats()
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.handleConnection(serverConn)
+		close(done)
+	}()
+
+	request := "GET /stats.txt HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := clientConn.Write([]byte(request)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	response, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	clientConn.Close()
+	<-done
+
+	after := server.Stats()
+
+	if got := after.BytesRead - before.BytesRead; got < uint64(len(request)) {
+		t.Errorf("BytesRead increased by %d, want at least %d", got, len(request))
+	}
+	if got := after.BytesWritten - before.BytesWritten; got < uint64(len(response)) {
+		t.Errorf("BytesWritten increased by %d, want at least %d", got, len(response))
+	}
+	if got := after.ConnectionsTotal - before.ConnectionsTotal; got != 1 {
+		t.Errorf("ConnectionsTotal increased by %d, want 1", got)
+	}
+}
+
+// TestShutdownRejectsKeptAliveRequests tests that requests arriving during shutdown get a 503
+func TestShutdownRejectsKeptAliveRequests(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "test.txt"), []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go server.handleConnection(serverConn)
+
+	clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(clientConn)
+
+	fmt.Fprintf(clientConn, "GET /test.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, headers, _, err := readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read first response: %v", err)
+	}
+	if !strings.Contains(status, "200 OK") || headers["Connection"] != "keep-alive" {
+		t.Fatalf("First response = %q with Connection %q, want 200 keep-alive", status, headers["Connection"])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+
+	fmt.Fprintf(clientConn, "GET /test.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, headers, _, err = readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	if !strings.Contains(status, "503 Service Unavailable") {
+		t.Errorf("Second response status = %q, want 503 Service Unavailable", status)
+	}
+	if headers["Connection"] != "close" {
+		t.Errorf("Connection = %q, want close", headers["Connection"])
+	}
+
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected EOF after 503, got %v", err)
+	}
+}
+
+// TestMIMETypeDetection tests MIME type detection for various file extensions
+func TestMIMETypeDetection(t *testing.T) {
+	tempDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
+
+	testFiles := map[string]string{
+		"test.html": "text/html; charset=utf-8",
+		"test.css":  "text/css; charset=utf-8",
+		"test.js":   "application/javascript; charset=utf-8",
+		"test.json": "application/json; charset=utf-8",
+		"test.xml":  "application/xml; charset=utf-8",
+		"test.txt":  "text/plain; charset=utf-8",
+		"test.png":  "image/png",
+		"test.jpg":  "image/jpeg",
+		"test.gif":  "image/gif",
+		"test.pdf":  "application/pdf",
+		"noext":     "text/plain; charset=utf-8", // Default for unknown extensions
+	}
+
+	// Create test files
+	for filename := range testFiles {
+		filePath := filepath.Join(tempDir, filename)
+		if err := os.WriteFile(filePath, []byte("test content"), 0644); err != nil {
+			t.Fatalf("Failed to create file %s: %v", filename, err)
+		}
+	}
+
+	for filename, expectedMIME := range testFiles {
+		t.Run(filename, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     "/" + filename,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp := server.handleRequest(req)
+
+			if resp.StatusCode != 200 {
+				t.Fatalf("Expected 200 OK, got %d", resp.StatusCode)
+			}
+
+			if resp.Headers["Content-Type"] != expectedMIME {
+				t.Errorf("MIME type = %q, want %q", resp.Headers["Content-Type"], expectedMIME)
+			}
+		})
+	}
+}
+
+// TestQueryStringHandling tests handling of query strings in URLs
+func TestQueryStringHandling(t *testing.T) {
+	tempDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
+
+	// Create test file
+	testFile := filepath.Join(tempDir, "query-test.html")
+	if err := os.WriteFile(testFile, []byte("<html>test</html>"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	testPaths := []string{
+		"/query-test.html",
+		"/query-test.html?param=value",
+		"/query-test.html?multiple=params&test=123",
+		"/query-test.html?empty=&null",
+	}
+
+	for _, path := range testPaths {
+		t.Run(path, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     path,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp := server.handleRequest(req)
+
+			// All should return 200 OK since query strings should be ignored for file serving
+			if resp.StatusCode != 200 {
+				t.Errorf("Expected 200 OK for %s, got %d", path, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestPercentEncodedPaths tests that paths are decoded once before routing
+func TestPercentEncodedPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewHTTPServer("127.0.0.1:0", tempDir, logger)
+
+	if err := os.WriteFile(filepath.Join(tempDir, "file with spaces.txt"), []byte("spaces"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(tempDir, "a"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "a", "b.txt"), []byte("nested"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedPath   string
+	}{
+		{"encoded spaces", "/file%20with%20spaces.txt", 200, "/file with spaces.txt"},
+		{"encoded spaces with query", "/file%20with%20spaces.txt?x=1", 200, "/file with spaces.txt"},
+		{"plain separator", "/a/b.txt", 200, "/a/b.txt"},
+		{"encoded separator", "/a%2Fb.txt", 404, "/a%2Fb.txt"},
+		{"encoded lowercase separator", "/a%2fb.txt", 404, "/a%2Fb.txt"},
+		{"invalid escape", "/bad%zz.txt", 400, ""},
+		{"encoded null byte", "/test%00.txt", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				Method:   "GET",
+				Path:     tt.path,
+				Protocol: "HTTP/1.1",
+				Headers:  make(map[string]string),
+			}
+
+			resp := server.handleRequest(req)
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status code = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+
+			if tt.expectedPath != "" {
+				if req.Path != tt.expectedPath {
+					t.Errorf("Decoded path = %q, want %q", req.Path, tt.expectedPath)
+				}
+				if req.RawPath != tt.path {
+					t.Errorf("RawPath = %q, want %q", req.RawPath, tt.path)
+				}
+			}
+		})
+	}
+}
+
+// checksumReader hashes what is read through it and stores the digest in
+// trailers once the source is exhausted
+type checksumReader struct {
+	io.Reader
+	hash     hash.Hash
+	trailers map[string]string
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		c.trailers["X-Checksum"] = hex.EncodeToString(c.hash.Sum(nil))
+	}
+	return n, err
+}
+
+func (c *checksumReader) Close() error { return nil }
+
+func TestChunkedResponseTrailers(t *testing.T) {
+	body := strings.Repeat("streamed data ", 5000)
+	sum := sha256.Sum256([]byte(body))
+
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.StreamFlushBytes = 16 * 1024
+	server.Router.AddRoute("/stream", HandlerFunc(func(req *Request) (*Response, error) {
+		trailers := map[string]string{"X-Checksum": ""}
+		resp := ChunkedResponse(200, "text/plain", &checksumReader{
+			Reader:   strings.NewReader(body),
+			hash:     sha256.New(),
+			trailers: trailers,
+		})
+		resp.Trailers = trailers
+		return resp, nil
+	}))
+
+	t.Run("HTTP/1.1 is chunked with trailers", func(t *testing.T) {
+		out := server.ServeRaw([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\nTE: trailers\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if !reflect.DeepEqual(resp.TransferEncoding, []string{"chunked"}) {
+			t.Errorf("TransferEncoding = %v, want [chunked]", resp.TransferEncoding)
+		}
+		if resp.Header.Get("Content-Length") != "" {
+			t.Errorf("Unexpected Content-Length %q on a chunked response", resp.Header.Get("Content-Length"))
+		}
+		if _, ok := resp.Trailer["X-Checksum"]; !ok {
+			t.Fatalf("Trailer header did not announce X-Checksum: %v", resp.Trailer)
+		}
+
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read chunked body: %v", err)
+		}
+		if string(got) != body {
+			t.Errorf("Body length = %d, want %d", len(got), len(body))
+		}
+		if checksum := resp.Trailer.Get("X-Checksum"); checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("X-Checksum trailer = %q, want %q", checksum, hex.EncodeToString(sum[:]))
+		}
+	})
+
+	t.Run("HTTP/1.0 is delimited by close", func(t *testing.T) {
+		out := server.ServeRaw([]byte("GET /stream HTTP/1.0\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if len(resp.TransferEncoding) != 0 {
+			t.Errorf("TransferEncoding = %v, want none for HTTP/1.0", resp.TransferEncoding)
+		}
+		if !resp.Close {
+			t.Error("Expected Connection: close to delimit the body")
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != body {
+			t.Errorf("Body length = %d, want %d", len(got), len(body))
+		}
+	})
+}
+
+// TestTextprotoHeaders checks that the net/textproto header reader agrees with
+// the built-in one on well-formed and malformed input
+func TestTextprotoHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	builtin := NewHTTPServer("127.0.0.1:0", t.TempDir(), logger)
+	textprotoServer := NewHTTPServer("127.0.0.1:0", t.TempDir(), logger)
+	textprotoServer.TextprotoHeaders = true
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"simple GET", "GET /test HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\nAccept: */*\r\n\r\n", false},
+		{"body", "POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nHello World", false},
+		{"repeated Content-Length", "POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nHello", false},
+		{"Content-Length list", "POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5, 5\r\n\r\nHello", false},
+		{"obsolete line folding", "GET /test HTTP/1.1\r\nHost: localhost\r\nX-Folded: first\r\n second\r\n\tthird\r\n\r\n", false},
+		{"empty value", "GET /test HTTP/1.1\r\nHost: localhost\r\nX-Empty:\r\n\r\n", false},
+		{"LF line endings", "GET /test HTTP/1.1\nHost: localhost\nAccept: */*\n\n", false},
+		{"HTTP/1.0 body until close", "POST /test HTTP/1.0\r\nContent-Type: text/plain\r\n\r\nuntil close", false},
+		{"header without colon", "GET /test HTTP/1.1\r\nHost: localhost\r\nNoColon\r\n\r\n", true},
+		{"whitespace before colon", "GET /test HTTP/1.1\r\nHost : localhost\r\n\r\n", true},
+		{"empty header name", "GET /test HTTP/1.1\r\nHost: localhost\r\n: value\r\n\r\n", true},
+		{"continuation before first header", "GET /test HTTP/1.1\r\n folded\r\nHost: localhost\r\n\r\n", true},
+		{"bare CR in value", "GET /test HTTP/1.1\r\nHost: localhost\r\nX-Bad: a\rb\r\n\r\n", true},
+		{"conflicting Content-Length", "POST /test HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nHello!", true},
+		{"missing Host", "GET /test HTTP/1.1\r\nAccept: */*\r\n\r\n", true},
+		{"duplicate Host", "GET /test HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantErr := builtin.parseRequest(bufio.NewReader(strings.NewReader(tt.input)))
+			got, gotErr := textprotoServer.parseRequest(bufio.NewReader(strings.NewReader(tt.input)))
+
+			if (wantErr != nil) != tt.wantErr || (gotErr != nil) != tt.wantErr {
+				t.Fatalf("errors: built-in %v, textproto %v, want error %v", wantErr, gotErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				if errors.Is(wantErr, errMalformedHeader) != errors.Is(gotErr, errMalformedHeader) {
+					t.Errorf("errors differ in kind: built-in %v, textproto %v", wantErr, gotErr)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("textproto parsed %+v, built-in parsed %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestTextprotoHeadersLimits checks that header limits still apply to the
+// textproto reader and that the body and later requests are left intact
+func TestTextprotoHeadersLimits(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.TextprotoHeaders = true
+	server.MaxHeaderLineBytes = 64
+	server.MaxHeaderBytes = 256
+	server.Router.AddRoute("/", &testHandler{response: "ok"})
+	server.Router.(*HTTPRouter).AddMethodRoute("POST", "/echo", &EchoHandler{})
+
+	many := "GET / HTTP/1.1\r\nHost: localhost\r\n" + strings.Repeat("X-Filler: 0123456789\r\n", 20) + "\r\n"
+
+	tests := []struct {
+		name          string
+		request       string
+		expected      string
+		expectedLimit string
+	}{
+		{"within limits", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", "200", ""},
+		{"long header line", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\n", "400", "max header line 64 bytes"},
+		{"too many header bytes", many, "431", "max header size 256 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if code := strings.Fields(status)[1]; code != tt.expected {
+				t.Errorf("Status = %q, want %s", status, tt.expected)
+			}
+			if tt.expectedLimit != "" {
+				if !strings.Contains(string(body), tt.expectedLimit) {
+					t.Errorf("Body = %q, want it to name %q", body, tt.expectedLimit)
+				}
+				if headers["Connection"] != "close" {
+					t.Errorf("Expected the connection to close, got Connection %q", headers["Connection"])
+				}
+			}
+		})
+	}
+
+	t.Run("body and pipelined request", func(t *testing.T) {
+		raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nHello" +
+			"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+		reader := bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw))))
+		for i := 0; i < 2; i++ {
+			status, _, body, err := readTestResponse(reader)
+			if err != nil {
+				t.Fatalf("Failed to read response %d: %v", i+1, err)
+			}
+			if code := strings.Fields(status)[1]; code != "200" {
+				t.Errorf("Response %d status = %q, want 200", i+1, status)
+			}
+			if i == 0 && !strings.Contains(string(body), `"body":"Hello"`) {
+				t.Errorf("Echoed body = %s, want the request body Hello", body)
+			}
+		}
+	})
+}
+
+// TestLifecycleHooks tests that start and shutdown hooks run in order
+func TestLifecycleHooks(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name)
+	}
+
+	listening := make(chan bool, 1)
+	server.OnStart(func() error { record("start 1"); return nil })
+	server.OnStart(func() error {
+		record("start 2")
+		listening <- server.ListenerAddr() != nil
+		return nil
+	})
+	server.OnShutdown(func() { record("shutdown 1") })
+	server.OnShutdown(func() { record("shutdown 2") })
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(context.Background())
+	}()
+
+	if <-listening {
+		t.Error("Start hooks should run before the server listens")
+	}
+	for server.ListenerAddr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Second Shutdown error: %v", err)
+	}
+	if err := <-serverErr; err != ErrServerClosed {
+		t.Errorf("ListenAndServe error = %v, want %v", err, ErrServerClosed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"start 1", "start 2", "shutdown 1", "shutdown 2"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Hooks ran as %v, want %v", calls, want)
+	}
+}
+
+// TestReadinessProbe tests that /readyz only reports ready between startup
+// finishing and shutdown starting, while /healthz always answers
+func TestReadinessProbe(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	router := server.Router.(*HTTPRouter)
+	router.AddRoute("/healthz", &HealthHandler{})
+	router.AddRoute("/readyz", &ReadinessHandler{Server: server})
+
+	probe := func(path string) string {
+		raw := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+		if err != nil {
+			t.Fatalf("Failed to read %s response: %v", path, err)
+		}
+		return strings.Fields(status)[1]
+	}
+
+	if code := probe("/readyz"); code != "503" {
+		t.Errorf("/readyz before startup = %s, want 503", code)
+	}
+	if code := probe("/healthz"); code != "200" {
+		t.Errorf("/healthz before startup = %s, want 200", code)
+	}
+
+	warming := make(chan struct{})
+	server.OnStart(func() error {
+		<-warming
+		return nil
+	})
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(context.Background())
+	}()
+
+	if code := probe("/readyz"); code != "503" {
+		t.Errorf("/readyz while start hooks run = %s, want 503", code)
+	}
+	close(warming)
+	for server.ListenerAddr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", server.ListenerAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "GET /readyz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, _, _, err := readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if code := strings.Fields(status)[1]; code != "200" {
+		t.Errorf("/readyz once started = %s, want 200", code)
+	}
+
+	// The open keep-alive connection holds Shutdown in its drain
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		shutdownDone <- server.Shutdown(ctx)
+	}()
+	for server.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fmt.Fprint(conn, "GET /readyz HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, _, _, err = readTestResponse(reader)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if code := strings.Fields(status)[1]; code != "503" {
+		t.Errorf("/readyz while draining = %s, want 503", code)
+	}
+	if resp, _ := (&ReadinessHandler{Server: server}).Handle()(&Request{}); resp.StatusCode != 503 {
+		t.Errorf("ReadinessHandler while draining = %d, want 503", resp.StatusCode)
+	}
+
+	<-shutdownDone
+	if err := <-serverErr; err != ErrServerClosed {
+		t.Errorf("ListenAndServe error = %v, want %v", err, ErrServerClosed)
+	}
+}
+
+// TestReload tests that reloaded settings apply to later requests
+func TestReload(t *testing.T) {
+	oldRoot, newRoot := t.TempDir(), t.TempDir()
+	for dir, content := range map[string]string{oldRoot: "old", newRoot: "new"} {
+		if err := os.WriteFile(filepath.Join(dir, "site.css"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", oldRoot, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Middlewares = append(server.Middlewares, server.CORSMiddleware())
+
+	get := func(origin string) (map[string]string, string) {
+		raw := "GET /site.css HTTP/1.1\r\nHost: localhost\r\nOrigin: " + origin + "\r\n\r\n"
+		_, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return headers, string(body)
+	}
+
+	headers, body := get("https://app.example")
+	if headers["Access-Control-Allow-Origin"] != "" {
+		t.Errorf("CORS headers sent before any origins were allowed: %v", headers)
+	}
+	if body != "old" || headers["Cache-Control"] != "public, max-age=3600" {
+		t.Errorf("Got %q with Cache-Control %q, want the old root's file with the default lifetime", body, headers["Cache-Control"])
+	}
+
+	err := server.Reload(ReloadConfig{
+		FileDirectory: newRoot,
+		CORSOrigins:   []string{"https://app.example"},
+		CacheMaxAge:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	headers, body = get("https://app.example")
+	if headers["Access-Control-Allow-Origin"] != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the newly allowed origin", headers["Access-Control-Allow-Origin"])
+	}
+	if body != "new" || headers["Cache-Control"] != "public, max-age=86400" {
+		t.Errorf("Got %q with Cache-Control %q, want the new root's file cached for a day", body, headers["Cache-Control"])
+	}
+	if headers, _ := get("https://other.example"); headers["Access-Control-Allow-Origin"] != "" {
+		t.Errorf("Origin not in the reloaded list was allowed: %v", headers)
+	}
+
+	// A bad root is refused without changing anything
+	if err := server.Reload(ReloadConfig{FileDirectory: filepath.Join(newRoot, "missing")}); err == nil {
+		t.Error("Expected an error reloading a missing directory")
+	}
+	if headers, body := get("https://app.example"); body != "new" || headers["Access-Control-Allow-Origin"] == "" {
+		t.Errorf("Failed reload changed the settings: %q, %v", body, headers)
+	}
+}
+
+// TestFailingStartHook tests that a failing start hook stops the server from listening
+func TestFailingStartHook(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	errWarmup := errors.New("warmup failed")
+	laterRan := false
+	server.OnStart(func() error { return errWarmup })
+	server.OnStart(func() error { laterRan = true; return nil })
+
+	if err := server.ListenAndServe(context.Background()); !errors.Is(err, errWarmup) {
+		t.Errorf("ListenAndServe error = %v, want %v", err, errWarmup)
+	}
+	if laterRan {
+		t.Error("Hooks after a failing one should not run")
+	}
+	if addr := server.ListenerAddr(); addr != nil {
+		t.Errorf("ListenerAddr() = %v, want nil after a failed start", addr)
+	}
+}
+
+// TestResponseHook tests that the response hook sees served files and server errors alike
+func TestResponseHook(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "index.html"), []byte("<h1>hi</h1>"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.AddRoute("/index.html", &FileHandler{FileDirectory: tempDir, Logger: server.Logger})
+	server.Router.AddRoute("/fail", HandlerFunc(func(req *Request) (*Response, error) {
+		return nil, errors.New("boom")
+	}))
+
+	var paths []string
+	server.SetResponseHook(func(req *Request, resp *Response) {
+		paths = append(paths, req.Path)
+		resp.Headers["X-Deploy-Version"] = "v1.2.3"
+	})
+
+	tests := []struct {
+		name           string
+		request        string
+		expectedStatus string
+	}{
+		{"served file", "GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n", "200"},
+		{"not found", "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n", "404"},
+		{"method not allowed", "DELETE /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n", "405"},
+		{"handler error", "GET /fail HTTP/1.1\r\nHost: localhost\r\n\r\n", "500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte(tt.request))
+			status, headers, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if code := strings.Fields(status)[1]; code != tt.expectedStatus {
+				t.Errorf("Status = %q, want %s", status, tt.expectedStatus)
+			}
+			if headers["X-Deploy-Version"] != "v1.2.3" {
+				t.Errorf("X-Deploy-Version = %q, want v1.2.3", headers["X-Deploy-Version"])
+			}
+		})
+	}
+
+	if want := []string{"/index.html", "/missing", "/index.html", "/fail"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Hook saw paths %v, want %v", paths, want)
+	}
+}
+
+// TestKeepRawHead tests that the request head is kept byte for byte only when asked
+func TestKeepRawHead(t *testing.T) {
+	head := "POST /submit?x=1 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"X-Spacing:   kept  \n" +
+		"X-Folded: first\r\n" +
+		"\tsecond\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n"
+	input := head + "Hello"
+
+	for _, textproto := range []bool{false, true} {
+		t.Run(fmt.Sprintf("textproto=%v", textproto), func(t *testing.T) {
+			server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			server.TextprotoHeaders = textproto
+
+			req, err := server.parseRequest(bufio.NewReader(strings.NewReader(input)))
+			if err != nil {
+				t.Fatalf("Failed to parse request: %v", err)
+			}
+			if req.RawHead != nil {
+				t.Errorf("RawHead = %q, want nil without KeepRawHead", req.RawHead)
+			}
+
+			server.KeepRawHead = true
+			req, err = server.parseRequest(bufio.NewReader(strings.NewReader(input)))
+			if err != nil {
+				t.Fatalf("Failed to parse request: %v", err)
+			}
+			if string(req.RawHead) != head {
+				t.Errorf("RawHead = %q, want %q", req.RawHead, head)
+			}
+			if string(req.Body) != "Hello" {
+				t.Errorf("Body = %q, want %q", req.Body, "Hello")
+			}
+		})
+	}
+}
+
+// addrConn is a net.Conn reporting a chosen remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// TestMaxConnsPerIP tests that connections from one IP beyond the cap are
+// refused while other IPs, and the same IP after a close, are served
+func TestMaxConnsPerIP(t *testing.T) {
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.MaxConnsPerIP = 2
+	server.Router.AddRoute("/", &testHandler{response: "ok"})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// connect opens a connection from ip and reports whether it is served
+	connect := func(ip string) (net.Conn, bool) {
+		clientConn, serverConn := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.handleConnection(&addrConn{Conn: serverConn, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}})
+		}()
+
+		clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			clientConn.Close()
+			return nil, false
+		}
+		if _, _, _, err := readTestResponse(bufio.NewReader(clientConn)); err != nil {
+			clientConn.Close()
+			return nil, false
+		}
+		return clientConn, true
+	}
+
+	first, ok := connect("192.0.2.10")
+	if !ok {
+		t.Fatal("First connection was refused")
+	}
+	second, ok := connect("192.0.2.10")
+	if !ok {
+		t.Fatal("Second connection was refused")
+	}
+	if conn, ok := connect("192.0.2.10"); ok {
+		conn.Close()
+		t.Error("Third connection from the same IP should be refused")
+	}
+	if conn, ok := connect("198.51.100.20"); !ok {
+		t.Error("Another IP should not be limited")
+	} else {
+		conn.Close()
+	}
+
+	// Closing a connection frees its slot once the server notices
+	first.Close()
+	var again net.Conn
+	for deadline := time.Now().Add(2 * time.Second); again == nil && time.Now().Before(deadline); {
+		if again, ok = connect("192.0.2.10"); !ok {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if again == nil {
+		t.Fatal("Expected a slot to free up after a connection closed")
+	}
+
+	again.Close()
+	second.Close()
+	wg.Wait()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.ipConns) != 0 {
+		t.Errorf("Expected no counters after all connections closed, got %v", server.ipConns)
+	}
+}
+
+// TestBasePath tests serving under a mount point and the links generated there
+func TestBasePath(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "foo.txt"), []byte("foo"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "docs"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "docs", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.BasePath = "/files/"
+	server.Router.(*HTTPRouter).SetFallback(&FileHandler{FileDirectory: tempDir, Logger: server.Logger, EnableDirectoryListing: true})
+	rules := &Rules{Redirects: []RedirectRule{{From: "/old.txt", To: "/foo.txt", Status: 301}}}
+	rules.Register(server.Router)
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedStatus string
+		expectedBody   string
+		location       string
+	}{
+		{"file under the base path", "/files/foo.txt", "200", "foo", ""},
+		{"missing prefix", "/foo.txt", "404", "", ""},
+		{"prefix without separator", "/filesfoo.txt", "404", "", ""},
+		{"listing links keep the base path", "/files/docs/", "200", `href="/files/docs/a.txt"`, ""},
+		{"redirects stay under the base path", "/files/old.txt", "301", "", "/files/foo.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := server.ServeRaw([]byte("GET " + tt.target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			status, headers, body, err := readTestResponse(bufio.NewReader(bytes.NewReader(out)))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if code := strings.Fields(status)[1]; code != tt.expectedStatus {
+				t.Errorf("Status = %q, want %s", status, tt.expectedStatus)
+			}
+			if tt.expectedBody != "" && !strings.Contains(string(body), tt.expectedBody) {
+				t.Errorf("Body = %q, want it to contain %q", body, tt.expectedBody)
+			}
+			if headers["Location"] != tt.location {
+				t.Errorf("Location = %q, want %q", headers["Location"], tt.location)
+			}
+		})
+	}
+}
+
+// TestHeadUncompressedLength tests that HEAD reports the uncompressed size
+// even when GET would be gzipped
+func TestHeadUncompressedLength(t *testing.T) {
+	tempDir := t.TempDir()
+	content := strings.Repeat("compressible text ", 500)
+	if err := os.WriteFile(filepath.Join(tempDir, "page.txt"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	for _, cacheGzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CacheGzip=%v", cacheGzip), func(t *testing.T) {
+			server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			server.Router.(*HTTPRouter).SetFallback(&FileHandler{FileDirectory: tempDir, Logger: server.Logger, CacheGzip: cacheGzip})
+
+			fetch := func(method string) map[string]string {
+				raw := method + " /page.txt HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"
+				// Parse the head alone, HEAD responses announce a body they don't carry
+				head, _, found := strings.Cut(string(server.ServeRaw([]byte(raw))), "\r\n\r\n")
+				if !found {
+					t.Fatalf("No end of headers in %s response %q", method, head)
+				}
+				headers := make(map[string]string)
+				for _, line := range strings.Split(head, "\r\n")[1:] {
+					key, value, _ := strings.Cut(line, ": ")
+					headers[key] = value
+				}
+				return headers
+			}
+
+			if get := fetch("GET"); get["Content-Encoding"] != "gzip" {
+				t.Fatalf("GET Content-Encoding = %q, want gzip", get["Content-Encoding"])
+			}
+
+			head := fetch("HEAD")
+			if encoding := head["Content-Encoding"]; encoding != "" && encoding != "identity" {
+				t.Errorf("HEAD Content-Encoding = %q, want identity", encoding)
+			}
+			if head["Content-Length"] != strconv.Itoa(len(content)) {
+				t.Errorf("HEAD Content-Length = %q, want %d", head["Content-Length"], len(content))
+			}
+		})
+	}
+}
+
+// TestHeadRangeRequest tests that a ranged HEAD gets the partial response's
+// headers without its body
+func TestHeadRangeRequest(t *testing.T) {
+	tempDir := t.TempDir()
+	content := strings.Repeat("0123456789", 50)
+	if err := os.WriteFile(filepath.Join(tempDir, "data.bin"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.Router.(*HTTPRouter).SetFallback(&FileHandler{FileDirectory: tempDir, Logger: server.Logger})
+
+	raw := "HEAD /data.bin HTTP/1.1\r\nHost: localhost\r\nRange: bytes=0-99\r\n\r\n"
+	head, body, found := strings.Cut(string(server.ServeRaw([]byte(raw))), "\r\n\r\n")
+	if !found {
+		t.Fatalf("No end of headers in response %q", head)
+	}
+	lines := strings.Split(head, "\r\n")
+	if code := strings.Fields(lines[0])[1]; code != "206" {
+		t.Fatalf("Status = %s, want 206", code)
+	}
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, ": ")
+		headers[key] = value
+	}
+	if got := headers["Content-Range"]; got != fmt.Sprintf("bytes 0-99/%d", len(content)) {
+		t.Errorf("Content-Range = %q, want %q", got, fmt.Sprintf("bytes 0-99/%d", len(content)))
+	}
+	if got := headers["Content-Length"]; got != "100" {
+		t.Errorf("Content-Length = %q, want 100", got)
+	}
+	if body != "" {
+		t.Errorf("HEAD response carried a body: %q", body)
+	}
+}
+
+// TestMaxResponseHeaders tests that extra response headers are dropped
+// deterministically, keeping the ones that frame the response
+func TestMaxResponseHeaders(t *testing.T) {
+	var logs bytes.Buffer
+	server := NewHTTPServer("127.0.0.1:0", t.TempDir(), slog.New(slog.NewTextHandler(&logs, nil)))
+	server.MaxResponseHeaders = 8
+
+	resp := HTTPBaseResponse(200, "OK")
+	for i := 0; i < 20; i++ {
+		resp.Headers[fmt.Sprintf("X-Extra-%02d", i)] = "value"
+	}
+
+	var out bytes.Buffer
+	writer := bufio.NewWriter(&out)
+	if err := server.writeResponse(writer, resp); err != nil {
+		t.Fatalf("Failed to write response: %v", err)
+	}
+
+	_, headers, body, err := readTestResponse(bufio.NewReader(&out))
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if len(headers) != 8 {
+		t.Errorf("Got %d headers, want 8: %v", len(headers), headers)
+	}
+
+	// Four framing headers, then the rest in name order
+	for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Connection", "Cache-Control", "Server", "X-Extra-00", "X-Extra-01"} {
+		if _, ok := headers[name]; !ok {
+			t.Errorf("Expected %s to be kept, got %v", name, headers)
+		}
+	}
+	if string(body) != "200 OK" {
+		t.Errorf("Body = %q, want %q", body, "200 OK")
+	}
+	if !strings.Contains(logs.String(), "dropped response headers over the limit") {
+		t.Errorf("Expected a warning about dropped headers, got:\n%s", logs.String())
+	}
+}
+
+// TestMisdirectedRequest tests that a server checking hosts before routing
+// answers 421 for an unknown Host, whether or not the path exists
+func TestMisdirectedRequest(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "index.html"), []byte("<h1>site</h1>"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewHTTPServer("127.0.0.1:0", tempDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server.PreRoutingMiddlewares = []Middleware{HostCheckMiddleware([]string{"www.example.com"})}
+
+	tests := []struct {
+		name           string
+		host           string
+		path           string
+		expectedStatus string
+	}{
+		{"configured site", "www.example.com", "/index.html", "200"},
+		{"configured site, missing file", "www.example.com", "/missing.html", "404"},
+		{"mismatched Host", "other.example.net", "/index.html", "421"},
+		{"mismatched Host, missing file", "other.example.net", "/missing.html", "421"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET " + tt.path + " HTTP/1.1\r\nHost: " + tt.host + "\r\n\r\n"
+			status, _, _, err := readTestResponse(bufio.NewReader(bytes.NewReader(server.ServeRaw([]byte(raw)))))
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if code := strings.Fields(status)[1]; code != tt.expectedStatus {
+				t.Errorf("Status = %q, want %s", status, tt.expectedStatus)
 			}
 		})
 	}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"strings"
+	"sync"
+)
+
+// TrieRouter implements the Router interface with a tree of path segments,
+// so a lookup costs O(path length) however many routes are registered.
+// Patterns are plain paths whose segments may be parameters or, as the
+// last segment, a wildcard:
+//
+//	/about
+//	/users/:id
+//	/static/*path
+//
+// ":name" matches one non-empty segment and "*name" the rest of the path.
+// Captured values are stored in Request.Params under their names, or "*"
+// for an unnamed wildcard. Static segments win over parameters, which win
+// over wildcards. Regex patterns are not supported.
+type TrieRouter struct {
+	mu       sync.RWMutex
+	root     *trieNode
+	fallback Handler
+}
+
+// trieNode is one path segment; routes ending at it hang off route and wildcard
+type trieNode struct {
+	static   map[string]*trieNode
+	param    *trieNode
+	route    *trieRoute
+	wildcard *trieRoute
+}
+
+// trieRoute is a registered handler with the names of the values it captures
+type trieRoute struct {
+	handler Handler
+	names   []string
+}
+
+// NewTrieRouter creates a new trie router
+func NewTrieRouter() *TrieRouter {
+	return &TrieRouter{root: &trieNode{}}
+}
+
+// AddRoute adds a new route to the router, replacing any route with the
+// same pattern
+func (r *TrieRouter) AddRoute(pattern string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node := r.root
+	var names []string
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "*") && i == len(segments)-1:
+			name := segment[1:]
+			if name == "" {
+				name = "*"
+			}
+			node.wildcard = &trieRoute{handler: handler, names: append(names, name)}
+			return
+		case strings.HasPrefix(segment, ":") && len(segment) > 1:
+			if node.param == nil {
+				node.param = &trieNode{}
+			}
+			names = append(names, segment[1:])
+			node = node.param
+		default:
+			if node.static == nil {
+				node.static = make(map[string]*trieNode)
+			}
+			child, ok := node.static[segment]
+			if !ok {
+				child = &trieNode{}
+				node.static[segment] = child
+			}
+			node = child
+		}
+	}
+	node.route = &trieRoute{handler: handler, names: names}
+}
+
+// SetFallback sets the handler used when no route matches
+func (r *TrieRouter) SetFallback(handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = handler
+}
+
+// Match finds a handler for the given path. The returned handler sets
+// Request.Params before calling the route's handler.
+func (r *TrieRouter) Match(path string) (HandlerFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	route, values := r.root.lookup(strings.TrimPrefix(path, "/"), nil)
+	if route == nil {
+		if r.fallback != nil {
+			return r.fallback.Handle(), true
+		}
+		return nil, false
+	}
+
+	handler := route.handler.Handle()
+	if len(route.names) == 0 {
+		return handler, true
+	}
+
+	params := make(map[string]string, len(route.names))
+	for i, name := range route.names {
+		params[name] = values[i]
+	}
+	return func(request *Request) (*Response, error) {
+		request.Params = params
+		return handler(request)
+	}, true
+}
+
+// unrouted returns the fallback when no route matches path
+func (r *TrieRouter) unrouted(path string) Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if route, _ := r.root.lookup(strings.TrimPrefix(path, "/"), nil); route != nil {
+		return nil
+	}
+	return r.fallback
+}
+
+// lookup finds the route for path, the remainder after this node's segment,
+// backtracking from static segments to parameters to wildcards
+func (n *trieNode) lookup(path string, values []string) (*trieRoute, []string) {
+	segment, rest, more := strings.Cut(path, "/")
+
+	if child, ok := n.static[segment]; ok {
+		if route, captured := child.descend(rest, more, values); route != nil {
+			return route, captured
+		}
+	}
+
+	if n.param != nil && segment != "" {
+		if route, captured := n.param.descend(rest, more, append(values, segment)); route != nil {
+			return route, captured
+		}
+	}
+
+	if n.wildcard != nil {
+		return n.wildcard, append(values, path)
+	}
+
+	return nil, nil
+}
+
+// descend continues the lookup below n, or ends it at n if no segments remain
+func (n *trieNode) descend(rest string, more bool, values []string) (*trieRoute, []string) {
+	if !more {
+		if n.route == nil {
+			return nil, nil
+		}
+		return n.route, values
+	}
+	return n.lookup(rest, values)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTrieRouter(t *testing.T) {
+	router := NewTrieRouter()
+	router.AddRoute("/", &testHandler{response: "root"})
+	router.AddRoute("/users", &testHandler{response: "users"})
+	router.AddRoute("/users/new", &testHandler{response: "new user"})
+	router.AddRoute("/users/:id", &testHandler{response: "user"})
+	router.AddRoute("/users/:id/posts/:post", &testHandler{response: "post"})
+	router.AddRoute("/static/*path", &testHandler{response: "static"})
+	router.AddRoute("/files/*", &testHandler{response: "files"})
+
+	tests := []struct {
+		path     string
+		expected string
+		params   map[string]string
+	}{
+		{"/", "root", nil},
+		{"/users", "users", nil},
+		{"/users/new", "new user", nil},
+		{"/users/42", "user", map[string]string{"id": "42"}},
+		{"/users/42/posts/7", "post", map[string]string{"id": "42", "post": "7"}},
+		{"/static/css/site.css", "static", map[string]string{"path": "css/site.css"}},
+		{"/static/", "static", map[string]string{"path": ""}},
+		{"/files/a.txt", "files", map[string]string{"*": "a.txt"}},
+		{"/users/", "", nil},
+		{"/users/42/posts", "", nil},
+		{"/static", "", nil},
+		{"/missing", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			h, found := router.Match(tt.path)
+			if tt.expected == "" {
+				if found {
+					t.Fatalf("Did not expect a handler for %s", tt.path)
+				}
+				return
+			}
+			if !found {
+				t.Fatalf("Expected a handler for %s", tt.path)
+			}
+
+			req := &Request{Path: tt.path}
+			if resp, _ := h(req); string(resp.Body) != tt.expected {
+				t.Errorf("Handler for %s = %s, want %s", tt.path, string(resp.Body), tt.expected)
+			}
+			if !reflect.DeepEqual(req.Params, tt.params) {
+				t.Errorf("Params for %s = %v, want %v", tt.path, req.Params, tt.params)
+			}
+		})
+	}
+}
+
+// TestTrieRouterBacktracking tests that a dead-end static branch falls back to a parameter
+func TestTrieRouterBacktracking(t *testing.T) {
+	router := NewTrieRouter()
+	router.AddRoute("/users/new/form", &testHandler{response: "form"})
+	router.AddRoute("/users/:id/edit", &testHandler{response: "edit"})
+
+	h, found := router.Match("/users/new/edit")
+	if !found {
+		t.Fatal("Expected /users/new/edit to match the parameter route")
+	}
+	req := &Request{}
+	if resp, _ := h(req); string(resp.Body) != "edit" {
+		t.Errorf("Expected edit handler, got %s", string(resp.Body))
+	}
+	if req.Params["id"] != "new" {
+		t.Errorf("Params[id] = %q, want %q", req.Params["id"], "new")
+	}
+}
+
+func TestTrieRouterFallback(t *testing.T) {
+	router := NewTrieRouter()
+	router.AddRoute("/api/status", &testHandler{response: "exact"})
+	router.SetFallback(&testHandler{response: "fallback"})
+
+	for path, expected := range map[string]string{"/api/status": "exact", "/index.html": "fallback"} {
+		h, found := router.Match(path)
+		if !found {
+			t.Fatalf("Expected a handler for %s", path)
+		}
+		if resp, _ := h(&Request{}); string(resp.Body) != expected {
+			t.Errorf("Handler for %s = %s, want %s", path, string(resp.Body), expected)
+		}
+	}
+}
+
+// TestTrieRouterParity checks that the trie and regex routers agree on
+// equivalent route tables
+func TestTrieRouterParity(t *testing.T) {
+	routes := []struct {
+		trie  string
+		regex string
+	}{
+		{"/", "/"},
+		{"/about", "/about"},
+		{"/users/:id", `^/users/[^/]+$`},
+		{"/users/:id/posts", `^/users/[^/]+/posts$`},
+		{"/static/*", `^/static/`},
+	}
+
+	trie := NewTrieRouter()
+	regex := NewHTTPRouter()
+	for _, route := range routes {
+		trie.AddRoute(route.trie, &testHandler{response: route.trie})
+		regex.AddRoute(route.regex, &testHandler{response: route.trie})
+	}
+
+	paths := []string{
+		"/", "/about", "/about/", "/abouts", "/users", "/users/", "/users/42",
+		"/users/42/", "/users/42/posts", "/users/42/posts/1", "/users//posts",
+		"/static", "/static/", "/static/js/app.js", "/missing",
+	}
+
+	for _, path := range paths {
+		trieHandler, trieFound := trie.Match(path)
+		regexHandler, regexFound := regex.Match(path)
+		if trieFound != regexFound {
+			t.Errorf("%s: trie found = %v, regex found = %v", path, trieFound, regexFound)
+			continue
+		}
+		if !trieFound {
+			continue
+		}
+		trieResp, _ := trieHandler(&Request{})
+		regexResp, _ := regexHandler(&Request{})
+		if string(trieResp.Body) != string(regexResp.Body) {
+			t.Errorf("%s: trie matched %s, regex matched %s", path, trieResp.Body, regexResp.Body)
+		}
+	}
+}
+
+func BenchmarkRouterMatch1000Routes(b *testing.B) {
+	trie := NewTrieRouter()
+	regex := NewHTTPRouter()
+	for i := 0; i < 1000; i++ {
+		trie.AddRoute(fmt.Sprintf("/api/resource%d/:id", i), &testHandler{response: "test"})
+		regex.AddRoute(fmt.Sprintf(`^/api/resource%d/[^/]+$`, i), &testHandler{response: "test"})
+	}
+
+	paths := []string{
+		"/api/resource0/1",
+		"/api/resource500/2",
+		"/api/resource999/3",
+		"/nonexistent",
+	}
+
+	routers := []struct {
+		name   string
+		router Router
+	}{{"trie", trie}, {"regex", regex}}
+
+	for _, r := range routers {
+		b.Run(r.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r.router.Match(paths[i%len(paths)])
+			}
+		})
+	}
+}